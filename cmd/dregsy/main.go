@@ -9,7 +9,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math/rand"
 	"os"
+	"time"
 
 	"github.com/yannh/dregsy/internal/pkg/log"
 	"github.com/yannh/dregsy/internal/pkg/sync"
@@ -22,31 +24,136 @@ func version() {
 	log.Info("\ndregsy %s\n", DregsyVersion)
 }
 
+const synopsis = `synopsis: dregsy -config={config file} [command] [args]
+
+commands:
+  sync                       run all tasks according to their schedules
+                             (default)
+  validate                   check the config, and report all problems
+  list-tags {task} {mapping} list the source images that would be synced
+                             for a mapping of a task
+  run {task}                 run a single task once, regardless of its
+                             schedule
+`
+
 //
 func main() {
 
 	configFile := flag.String("config", "", "path to config file")
-	flag.Parse()
+	logFormat := flag.String("log-format", "text",
+		"log format, one of 'text', 'json'")
+	logLevel := flag.String("log-level", "info",
+		"minimum log level, one of 'debug', 'info', 'warn', 'error'")
+	dryRun := flag.Bool("dry-run", false,
+		"run each task once, only printing what would be synced and pruned")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), synopsis+"\nflags:\n")
+		flag.PrintDefaults()
+	}
+
+	// command and its arguments may be mixed with the flags
+	var params []string
+	for args := os.Args[1:]; ; {
+		flag.CommandLine.Parse(args)
+		if args = flag.Args(); len(args) == 0 {
+			break
+		}
+		params = append(params, args[0])
+		args = args[1:]
+	}
+
+	cmd := ""
+	if len(params) > 0 {
+		cmd, params = params[0], params[1:]
+	}
+
+	format, err := log.ParseFormat(*logFormat)
+	failOnError(err)
+	log.SetFormat(format)
+	level, err := log.ParseLevel(*logLevel)
+	failOnError(err)
+	log.SetLevel(level)
 
 	if len(*configFile) == 0 {
 		version()
-		fmt.Println("synopsis: dregsy -config={config file}")
+		fmt.Print(synopsis)
 		os.Exit(1)
 	}
 
+	switch cmd {
+	case "", "sync":
+		checkParams(cmd, params, 0)
+	case "validate":
+		checkParams(cmd, params, 0)
+		validate(*configFile)
+		return
+	case "list-tags":
+		checkParams(cmd, params, 2)
+	case "run":
+		checkParams(cmd, params, 1)
+	default:
+		failOnError(fmt.Errorf("unknown command '%s'", cmd))
+	}
+
 	version()
 
+	// for randomizing task start times
+	rand.Seed(time.Now().UnixNano())
+
 	conf, err := sync.LoadConfig(*configFile)
-	failOnError(err)
+	failOnConfigError(err)
 
 	sync, err := sync.New(conf)
 	failOnError(err)
+	sync.SetDryRun(*dryRun)
+
+	switch cmd {
+	case "list-tags":
+		var refs []string
+		refs, err = sync.ListTags(conf, params[0], params[1])
+		if err == nil {
+			log.Println()
+			for _, ref := range refs {
+				fmt.Println(ref)
+			}
+		}
+	case "run":
+		err = sync.RunTask(conf, params[0])
+	default:
+		err = sync.SyncFromConfig(conf)
+	}
 
-	err = sync.SyncFromConfig(conf)
 	sync.Dispose()
 	failOnError(err)
 }
 
+// validate loads the config file, and reports all problems found with it
+func validate(file string) {
+	conf, err := sync.LoadConfig(file)
+	failOnConfigError(err)
+	log.Info("config '%s' is valid, %d task(s) defined", file,
+		len(conf.Tasks))
+}
+
+//
+func checkParams(cmd string, params []string, expected int) {
+	if len(params) != expected {
+		fmt.Print(synopsis)
+		failOnError(fmt.Errorf("command '%s' expects %d argument(s), got %d",
+			cmd, expected, len(params)))
+	}
+}
+
+// failOnConfigError reports each of the problems found when loading a config
+func failOnConfigError(err error) {
+	if err != nil {
+		for _, e := range sync.ConfigErrors(err) {
+			log.Error(e)
+		}
+		os.Exit(1)
+	}
+}
+
 //
 func failOnError(err error) {
 	if err != nil {
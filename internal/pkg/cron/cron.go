@@ -0,0 +1,235 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression with the standard five fields minute,
+// hour, day of month, month, and day of week
+type Schedule struct {
+	minute  []bool
+	hour    []bool
+	dom     []bool
+	month   []bool
+	dow     []bool
+	anyDom  bool
+	anyDow  bool
+	loc     *time.Location
+	literal string
+}
+
+// field bounds, and names accepted in place of numbers
+type bounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is Sunday as well
+	dows = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+// predefined schedules
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression, to be evaluated in loc, or UTC if loc is
+// nil. Besides numbers, fields may contain '*', lists, ranges, and steps, as
+// in '*/15', '1-5', or '0,30'. Months and days of week can also be given as
+// three letter names, e.g. 'jan' or 'mon-fri'. The macros '@yearly',
+// '@monthly', '@weekly', '@daily', and '@hourly' are supported as well. As
+// with classic cron, when both day of month and day of week are restricted,
+// a day matching either one is scheduled.
+func Parse(expr string, loc *time.Location) (*Schedule, error) {
+
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	spec := strings.TrimSpace(expr)
+	if m, ok := macros[strings.ToLower(spec)]; ok {
+		spec = m
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf(
+			"invalid cron expression '%s': expected 5 fields, got %d",
+			expr, len(fields))
+	}
+
+	ret := &Schedule{
+		loc:     loc,
+		literal: expr,
+		anyDom:  fields[2] == "*" || fields[2] == "?",
+		anyDow:  fields[4] == "*" || fields[4] == "?",
+	}
+
+	var err error
+	for _, f := range []struct {
+		set   *[]bool
+		field string
+		b     bounds
+	}{
+		{&ret.minute, fields[0], minutes},
+		{&ret.hour, fields[1], hours},
+		{&ret.dom, fields[2], doms},
+		{&ret.month, fields[3], months},
+		{&ret.dow, fields[4], dows},
+	} {
+		if *f.set, err = parseField(f.field, f.b); err != nil {
+			return nil, fmt.Errorf("invalid cron expression '%s': %v",
+				expr, err)
+		}
+	}
+
+	if ret.dow[7] {
+		ret.dow[0] = true
+	}
+
+	return ret, nil
+}
+
+//
+func parseField(field string, b bounds) ([]bool, error) {
+
+	ret := make([]bool, b.max+1)
+
+	for _, part := range strings.Split(field, ",") {
+
+		rng, step := part, 1
+		if ix := strings.Index(part, "/"); ix >= 0 {
+			rng = part[:ix]
+			s, err := strconv.Atoi(part[ix+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("invalid step in '%s'", part)
+			}
+			step = s
+		}
+
+		var from, to int
+		switch {
+		case rng == "*" || rng == "?":
+			from, to = b.min, b.max
+		case strings.Contains(rng, "-"):
+			ix := strings.Index(rng, "-")
+			var err error
+			if from, err = parseValue(rng[:ix], b); err != nil {
+				return nil, err
+			}
+			if to, err = parseValue(rng[ix+1:], b); err != nil {
+				return nil, err
+			}
+			if from > to {
+				return nil, fmt.Errorf("invalid range '%s'", rng)
+			}
+		default:
+			var err error
+			if from, err = parseValue(rng, b); err != nil {
+				return nil, err
+			}
+			to = from
+			// a single value with a step, such as '5/15', runs to the end
+			if strings.Contains(part, "/") {
+				to = b.max
+			}
+		}
+
+		for v := from; v <= to; v += step {
+			ret[v] = true
+		}
+	}
+
+	return ret, nil
+}
+
+//
+func parseValue(v string, b bounds) (int, error) {
+	if n, ok := b.names[strings.ToLower(v)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s'", v)
+	}
+	if n < b.min || n > b.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", n, b.min, b.max)
+	}
+	return n, nil
+}
+
+// Next returns the first time matching the schedule that is after t, or the
+// zero time if there is none within the next five years, e.g. for February
+// 30th
+func (s *Schedule) Next(t time.Time) time.Time {
+
+	orig := t.Location()
+	t = t.In(s.loc)
+	// start with the next full minute
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0,
+		s.loc)
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+
+		if !s.month[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+			continue
+		}
+
+		if !s.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0,
+				s.loc)
+			continue
+		}
+
+		if !s.minute[t.Minute()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(),
+				t.Minute()+1, 0, 0, s.loc)
+			continue
+		}
+
+		return t.In(orig)
+	}
+
+	return time.Time{}
+}
+
+//
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom[t.Day()]
+	dow := s.dow[t.Weekday()]
+	if s.anyDom || s.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+//
+func (s *Schedule) String() string {
+	return s.literal
+}
@@ -0,0 +1,71 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+
+	from := time.Date(2021, 3, 26, 10, 17, 30, 0, time.UTC) // a Friday
+
+	for _, testCase := range []struct {
+		expr   string
+		loc    *time.Location
+		expect time.Time
+	}{
+		{"* * * * *", nil, time.Date(2021, 3, 26, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", nil, time.Date(2021, 3, 26, 10, 30, 0, 0, time.UTC)},
+		{"5/20 * * * *", nil, time.Date(2021, 3, 26, 10, 25, 0, 0, time.UTC)},
+		{"0 3 * * *", nil, time.Date(2021, 3, 27, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", berlin, time.Date(2021, 3, 27, 2, 0, 0, 0, time.UTC)},
+		// switch to daylight saving time in Berlin
+		{"0 4 28 3 *", berlin, time.Date(2021, 3, 28, 2, 0, 0, 0, time.UTC)},
+		{"30 2 * * mon-fri", nil,
+			time.Date(2021, 3, 29, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", nil, time.Date(2021, 3, 28, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,15 * *", nil, time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)},
+		// day of month or day of week
+		{"0 12 1 * sat", nil, time.Date(2021, 3, 27, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", nil, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", nil, time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", nil, time.Date(2021, 3, 26, 11, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", nil, time.Time{}},
+	} {
+		s, err := Parse(testCase.expr, testCase.loc)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", testCase.expr, err)
+			continue
+		}
+		if next := s.Next(from); !next.Equal(testCase.expect) {
+			t.Errorf("%s: expected %v, got %v", testCase.expr,
+				testCase.expect, next)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"* * * foo *",
+	} {
+		if _, err := Parse(expr, nil); err == nil {
+			t.Errorf("'%s' should not parse", expr)
+		}
+	}
+}
@@ -5,9 +5,15 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -16,48 +22,407 @@ import (
 //
 var ToTerminal bool
 
+// serializes writing to stdout and stderr, so that output flushed from a
+// buffered logger is not interleaved with other output
+var outMutex sync.Mutex
+
+// the logger used by the package level functions
+var std = &Logger{}
+
+// messages below this level are dropped
+var level = LevelInfo
+
+// how messages are written
+var format = FormatText
+
 func init() {
 	ToTerminal = terminal.IsTerminal(int(os.Stdout.Fd()))
 }
 
+/* ----------------------------------------------------------------------------
+ * Level is the severity of a log message
+ */
+type Level int
+
+//
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// ParseLevel parses one of 'debug', 'info', 'warn', or 'error'
+func ParseLevel(s string) (Level, error) {
+	for ix, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(ix), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf(
+		"invalid log level '%s', must be one of '%s'", s,
+		strings.Join(levelNames, "', '"))
+}
+
+//
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// SetLevel sets the minimum level of messages that get written
+func SetLevel(l Level) {
+	level = l
+}
+
+/* ----------------------------------------------------------------------------
+ * Format is the output format of log messages
+ */
+type Format int
+
+//
+const (
+	// human readable text, with fields appended as key=value
+	FormatText Format = iota
+	// one JSON object per message
+	FormatJSON
+)
+
+// ParseFormat parses one of 'text' or 'json'
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf(
+		"invalid log format '%s', must be one of 'text', 'json'", s)
+}
+
+// SetFormat sets the output format; with JSON, output is never considered to
+// go to a terminal, so that raw output of external tools also gets passed
+// through the logger, and turned into JSON
+func SetFormat(f Format) {
+	format = f
+	if f == FormatJSON {
+		ToTerminal = false
+	}
+}
+
+// JSON returns true if messages are written as JSON
+func JSON() bool {
+	return format == FormatJSON
+}
+
+/* ----------------------------------------------------------------------------
+ * Fields are key/value pairs giving context to log messages, such as the task
+ * or tag a message is about
+ */
+type Fields map[string]interface{}
+
+// Logger writes log messages either straight to stdout and stderr, or when
+// buffered, collects them until flushed. Buffering is used for keeping the
+// output of concurrently running activities grouped together. Each message
+// carries the logger's fields. A nil Logger is usable, does not buffer, and
+// has no fields.
+type Logger struct {
+	buf    *buffer
+	fields Fields
+}
+
+//
+type buffer struct {
+	entries []entry
+	mutex   sync.Mutex
+}
+
+//
+type entry struct {
+	toErr bool
+	data  []byte
+}
+
+// Buffered returns a logger that collects all messages until Flush is called
+func Buffered() *Logger {
+	return std.Buffered()
+}
+
+// With returns a logger adding fields to all messages
+func With(fields Fields) *Logger {
+	return std.With(fields)
+}
+
 //
 func Println() {
-	Info("")
+	std.Println()
+}
+
+//
+func Debug(msg string, params ...interface{}) {
+	std.Debug(msg, params...)
 }
 
 //
 func Warning(msg string, params ...interface{}) {
-	log("WARN", msg, params...)
+	std.Warning(msg, params...)
 }
 
 //
 func Info(msg string, params ...interface{}) {
-	log("INFO", msg, params...)
+	std.Info(msg, params...)
 }
 
 //
-func log(level, msg string, params ...interface{}) {
-	msg = fmt.Sprintf(msg, params...)
+func Error(err error) bool {
+	return std.Error(err)
+}
+
+// With returns a logger with the fields of this logger plus fields, which
+// writes to the same buffer as this logger, if any
+func (l *Logger) With(fields Fields) *Logger {
+	ret := &Logger{fields: make(Fields)}
+	if l != nil {
+		ret.buf = l.buf
+		for k, v := range l.fields {
+			ret.fields[k] = v
+		}
+	}
+	for k, v := range fields {
+		ret.fields[k] = v
+	}
+	return ret
+}
+
+// Buffered returns a buffered logger with the fields of this logger
+func (l *Logger) Buffered() *Logger {
+	ret := l.With(nil)
+	ret.buf = &buffer{}
+	return ret
+}
+
+// IsBuffered returns true if this logger collects messages until flushed
+func (l *Logger) IsBuffered() bool {
+	return l != nil && l.buf != nil
+}
+
+// Println writes an empty line, for separating blocks of text output; with
+// JSON output, this does nothing
+func (l *Logger) Println() {
+	if format == FormatText {
+		l.log(LevelInfo, "")
+	}
+}
+
+//
+func (l *Logger) Debug(msg string, params ...interface{}) {
+	l.log(LevelDebug, msg, params...)
+}
+
+//
+func (l *Logger) Warning(msg string, params ...interface{}) {
+	l.log(LevelWarn, msg, params...)
+}
+
+//
+func (l *Logger) Info(msg string, params ...interface{}) {
+	l.log(LevelInfo, msg, params...)
+}
+
+// Error logs err, if not nil, and returns true in that case; with JSON
+// output, err goes into the 'error' field
+func (l *Logger) Error(err error) bool {
+	if err == nil {
+		return false
+	}
+	if format == FormatJSON {
+		l.With(Fields{"error": err}).log(LevelError, "error")
+	} else {
+		l.log(LevelError, "%v", err)
+	}
+	return true
+}
+
+//
+func (l *Logger) log(lvl Level, msg string, params ...interface{}) {
+
+	if lvl < level {
+		return
+	}
+
+	if len(params) > 0 {
+		msg = fmt.Sprintf(msg, params...)
+	}
+
+	var fields Fields
+	if l != nil {
+		fields = l.fields
+	}
+
+	if format == FormatJSON {
+		l.write(lvl == LevelError, formatJSON(lvl, msg, fields))
+	} else {
+		l.write(lvl == LevelError, formatText(lvl, msg, fields))
+	}
+}
+
+// Write writes raw output, e.g. from an external tool, to stdout; with JSON
+// output, each line becomes a message
+func (l *Logger) Write(p []byte) (n int, err error) {
+
+	if format != FormatJSON {
+		l.write(false, p)
+		return len(p), nil
+	}
+
+	for _, line := range strings.Split(string(p), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			l.log(LevelInfo, "%s", line)
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes all messages collected by a buffered logger
+func (l *Logger) Flush() {
+
+	if !l.IsBuffered() {
+		return
+	}
+
+	l.buf.mutex.Lock()
+	entries := l.buf.entries
+	l.buf.entries = nil
+	l.buf.mutex.Unlock()
+
+	outMutex.Lock()
+	defer outMutex.Unlock()
+	for _, e := range entries {
+		stream(e.toErr).Write(e.data)
+	}
+}
+
+//
+func (l *Logger) write(toErr bool, data []byte) {
+
+	if l.IsBuffered() {
+		l.buf.mutex.Lock()
+		defer l.buf.mutex.Unlock()
+		l.buf.entries = append(l.buf.entries,
+			entry{toErr: toErr, data: append([]byte{}, data...)})
+		return
+	}
+
+	outMutex.Lock()
+	defer outMutex.Unlock()
+	stream(toErr).Write(data)
+}
+
+//
+func stream(toErr bool) io.Writer {
+	if toErr {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// formatText renders a message as text, with a time stamp and level unless
+// writing to a terminal, and fields appended as key=value in sorted order
+func formatText(lvl Level, msg string, fields Fields) []byte {
+
+	buf := new(bytes.Buffer)
+
 	if !ToTerminal {
-		msg = fmt.Sprintf(
-			"%s [%s] %s", time.Now().Format(time.RFC3339), level, msg)
+		fmt.Fprintf(buf, "%s [%s] ", time.Now().Format(time.RFC3339),
+			strings.ToUpper(lvl.String()))
+	}
+
+	// with fields, trailing line breaks of the message go after them
+	trimmed := strings.TrimRight(msg, "\n")
+	buf.WriteString(trimmed)
+	for _, k := range sortedKeys(fields) {
+		fmt.Fprintf(buf, " %s=%s", k, textValue(fields[k]))
 	}
-	fmt.Print(msg)
-	if !strings.HasSuffix(msg, "\n") {
-		fmt.Println()
+	buf.WriteString(msg[len(trimmed):])
+
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteString("\n")
 	}
+	return buf.Bytes()
 }
 
 //
-func Error(err error) bool {
+func textValue(v interface{}) string {
+	var s string
+	switch val := v.(type) {
+	case error:
+		s = val.Error()
+	default:
+		s = fmt.Sprint(val)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatJSON renders a message as a single line JSON object, with time,
+// level, and message first, followed by the fields in sorted order;
+// durations are given in seconds
+func formatJSON(lvl Level, msg string, fields Fields) []byte {
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("{")
+	writeJSONField(buf, "time", time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(",")
+	writeJSONField(buf, "level", lvl.String())
+	buf.WriteString(",")
+	writeJSONField(buf, "msg", strings.TrimSpace(msg))
+
+	for _, k := range sortedKeys(fields) {
+		buf.WriteString(",")
+		writeJSONField(buf, k, jsonValue(fields[k]))
+	}
+
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+//
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
 	if err != nil {
-		if ToTerminal {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
-		} else {
-			fmt.Fprintf(os.Stderr, "%s [ERROR] %v\n",
-				time.Now().Format(time.RFC3339), err)
-		}
-		return true
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(k)
+	buf.WriteString(":")
+	buf.Write(v)
+}
+
+//
+func jsonValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case error:
+		return val.Error()
+	case time.Duration:
+		return val.Seconds()
+	case fmt.Stringer:
+		return val.String()
+	}
+	return v
+}
+
+//
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
 	}
-	return false
+	sort.Strings(keys)
+	return keys
 }
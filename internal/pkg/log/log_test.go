@@ -0,0 +1,147 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+
+	for _, n := range []string{"debug", "info", "WARN", "Error"} {
+		l, err := ParseLevel(n)
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': %v", n, err)
+		}
+		if l.String() != strings.ToLower(n) {
+			t.Errorf("expected '%s', got '%s'", strings.ToLower(n), l)
+		}
+	}
+
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected error for invalid level")
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("expected error for invalid format")
+	}
+}
+
+func TestFormatText(t *testing.T) {
+
+	defer func(tt bool) { ToTerminal = tt }(ToTerminal)
+	ToTerminal = true
+
+	out := string(formatText(LevelInfo, "syncing tag\n\n", Fields{
+		"tag":    "v1",
+		"target": "reg:5000/busybox",
+		"error":  errors.New("not found"),
+	}))
+	expected := "syncing tag error=\"not found\" tag=v1 " +
+		"target=reg:5000/busybox\n\n"
+	if out != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+
+	ToTerminal = false
+	out = string(formatText(LevelWarn, "retrying", nil))
+	if !strings.HasSuffix(out, " [WARN] retrying\n") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+
+	out := formatJSON(LevelError, "\nsync failed\n", Fields{
+		"task":     "t1",
+		"error":    errors.New("boom"),
+		"duration": 1500 * time.Millisecond,
+		"count":    3,
+	})
+
+	if !strings.HasSuffix(string(out), "}\n") ||
+		strings.Count(string(out), "\n") != 1 {
+		t.Errorf("expected a single line, got %q", out)
+	}
+	if !strings.HasPrefix(string(out), `{"time":`) {
+		t.Errorf("expected time to come first, got %q", out)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(out, &m); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out, err)
+	}
+
+	expected := map[string]interface{}{
+		"level":    "error",
+		"msg":      "sync failed",
+		"task":     "t1",
+		"error":    "boom",
+		"duration": 1.5,
+		"count":    float64(3),
+	}
+	for k, v := range expected {
+		if m[k] != v {
+			t.Errorf("expected %s to be %v, got %v", k, v, m[k])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, m["time"].(string)); err != nil {
+		t.Errorf("invalid time: %v", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+
+	defer func(l Level, f Format, tt bool) {
+		level = l
+		format = f
+		ToTerminal = tt
+	}(level, format, ToTerminal)
+	SetLevel(LevelWarn)
+	SetFormat(FormatJSON)
+
+	lg := With(Fields{"task": "t1"}).Buffered()
+	tlg := lg.With(Fields{"tag": "v1"})
+
+	tlg.Info("dropped")
+	tlg.Warning("kept")
+	tlg.Println()
+	tlg.Write([]byte("first line\n\nsecond line\n"))
+	SetLevel(LevelInfo)
+	tlg.Write([]byte("first line\n\nsecond line\n"))
+
+	tlg.Error(errors.New("boom"))
+
+	if !tlg.IsBuffered() || With(nil).IsBuffered() {
+		t.Error("unexpected buffering")
+	}
+
+	entries := lg.buf.entries
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+
+	for ix, msg := range []string{"kept", "first line", "second line"} {
+		var m map[string]interface{}
+		if err := json.Unmarshal(entries[ix].data, &m); err != nil {
+			t.Fatalf("invalid JSON %q: %v", entries[ix].data, err)
+		}
+		if m["msg"] != msg || m["task"] != "t1" || m["tag"] != "v1" {
+			t.Errorf("unexpected entry %q", entries[ix].data)
+		}
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(entries[3].data, &m); err != nil {
+		t.Fatalf("invalid JSON %q: %v", entries[3].data, err)
+	}
+	if m["level"] != "error" || m["msg"] != "error" || m["error"] != "boom" {
+		t.Errorf("unexpected error entry %q", entries[3].data)
+	}
+
+	// fields of derived loggers do not leak into their parents
+	if _, ok := lg.fields["tag"]; ok {
+		t.Error("parent logger got field of derived logger")
+	}
+}
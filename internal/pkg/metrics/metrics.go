@@ -0,0 +1,347 @@
+/*
+ *
+ */
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the Prometheus text format written by
+// a Registry
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry holds metrics, and exposes them in the Prometheus text format
+type Registry struct {
+	metrics []metric
+	mutex   sync.Mutex
+}
+
+// metric is implemented by all metric types
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Default is the registry the package level functions work on
+var Default = NewRegistry()
+
+//
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounter registers a counter with the Default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewGauge registers a gauge with the Default registry
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewHistogram registers a histogram with the Default registry
+func NewHistogram(name, help string, buckets []float64,
+	labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// Handler returns an HTTP handler exposing the Default registry
+func Handler() http.Handler {
+	return Default
+}
+
+//
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes all metrics in the Prometheus text format to w
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+
+	r.mutex.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mutex.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+//
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+//
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+//
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+/* ----------------------------------------------------------------------------
+ * common to all metric types: name, help text, and a series per combination
+ * of label values
+ */
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]interface{}
+	mutex  sync.Mutex
+}
+
+//
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]interface{}),
+	}
+}
+
+// get returns the series for values, created with create if not present yet;
+// the caller needs to hold the mutex
+func (f *family) get(values []string, create func() interface{}) interface{} {
+
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d",
+			f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\x00")
+	s, ok := f.series[key]
+	if !ok {
+		s = create()
+		f.series[key] = s
+	}
+	return s
+}
+
+// writeHeader writes help and type, and returns the series keys in sorted
+// order; the caller needs to hold the mutex
+func (f *family) writeHeader(w *bufio.Writer) []string {
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeSample writes a single sample line for the series with key, with
+// extra label pairs appended to the family's labels
+func (f *family) writeSample(w *bufio.Writer, suffix, key string, v float64,
+	extra ...string) {
+
+	var pairs []string
+	if len(f.labels) > 0 {
+		for ix, val := range strings.Split(key, "\x00") {
+			pairs = append(pairs,
+				fmt.Sprintf(`%s="%s"`, f.labels[ix], escapeValue(val)))
+		}
+	}
+	for ix := 0; ix+1 < len(extra); ix += 2 {
+		pairs = append(pairs,
+			fmt.Sprintf(`%s="%s"`, extra[ix], escapeValue(extra[ix+1])))
+	}
+
+	w.WriteString(f.name + suffix)
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+//
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+//
+func escapeValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+//
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+/* ----------------------------------------------------------------------------
+ * Counter is a value that only goes up
+ */
+type Counter struct {
+	*family
+}
+
+//
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: newFamily(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values by 1
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the counter for the given label
+// values
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metric %s: counter cannot decrease", c.name))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	*c.get(values, func() interface{} { return new(float64) }).(*float64) += v
+}
+
+//
+func (c *Counter) write(w *bufio.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, k := range c.writeHeader(w) {
+		c.writeSample(w, "", k, *c.series[k].(*float64))
+	}
+}
+
+/* ----------------------------------------------------------------------------
+ * Gauge is a value that can go up and down
+ */
+type Gauge struct {
+	*family
+}
+
+//
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{family: newFamily(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values to v
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	*g.get(values, func() interface{} { return new(float64) }).(*float64) = v
+}
+
+// Add adds v to the gauge for the given label values
+func (g *Gauge) Add(v float64, values ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	*g.get(values, func() interface{} { return new(float64) }).(*float64) += v
+}
+
+//
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, k := range g.writeHeader(w) {
+		g.writeSample(w, "", k, *g.series[k].(*float64))
+	}
+}
+
+/* ----------------------------------------------------------------------------
+ * Histogram counts observations in buckets
+ */
+type Histogram struct {
+	*family
+	buckets []float64
+}
+
+//
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// DurationBuckets are histogram buckets for durations in seconds, ranging
+// from a second to an hour
+var DurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// NewHistogram creates a histogram with the given upper bucket bounds, which
+// need to be sorted in increasing order; the +Inf bucket is added implicitly
+func (r *Registry) NewHistogram(name, help string, buckets []float64,
+	labels ...string) *Histogram {
+	h := &Histogram{
+		family:  newFamily(name, help, "histogram", labels),
+		buckets: buckets,
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records observation v for the given label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.get(values, func() interface{} {
+		return &histogramSeries{counts: make([]uint64, len(h.buckets))}
+	}).(*histogramSeries)
+	for ix, b := range h.buckets {
+		if v <= b {
+			s.counts[ix]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+//
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, k := range h.writeHeader(w) {
+		s := h.series[k].(*histogramSeries)
+		for ix, b := range h.buckets {
+			h.writeSample(w, "_bucket", k, float64(s.counts[ix]),
+				"le", formatFloat(b))
+		}
+		h.writeSample(w, "_bucket", k, float64(s.count), "le", "+Inf")
+		h.writeSample(w, "_sum", k, s.sum)
+		h.writeSample(w, "_count", k, float64(s.count))
+	}
+}
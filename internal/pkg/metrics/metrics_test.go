@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter.", "task", "result")
+	g := r.NewGauge("test_gauge", "A gauge\nwith two lines.")
+	h := r.NewHistogram("test_seconds", "A histogram.", []float64{1, 5},
+		"task")
+
+	c.Inc("t2", "ok")
+	c.Add(2, "t1", "ok")
+	c.Inc("t1", `"quoted"\`)
+	g.Set(1.5)
+	h.Observe(0.5, "t1")
+	h.Observe(3, "t1")
+	h.Observe(10, "t1")
+
+	expected := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{task="t1",result="\"quoted\"\\"} 1
+test_total{task="t1",result="ok"} 2
+test_total{task="t2",result="ok"} 1
+# HELP test_gauge A gauge\nwith two lines.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{task="t1",le="1"} 1
+test_seconds_bucket{task="t1",le="5"} 2
+test_seconds_bucket{task="t1",le="+Inf"} 3
+test_seconds_sum{task="t1"} 13.5
+test_seconds_count{task="t1"} 3
+`
+
+	buf := new(bytes.Buffer)
+	n, err := r.WriteTo(buf)
+	if err != nil {
+		t.Fatalf("error writing metrics: %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("expected %d bytes written, got %d", buf.Len(), n)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("unexpected content type '%s'", ct)
+	}
+	if rec.Body.String() != expected {
+		t.Errorf("unexpected response body:\n%s", rec.Body.String())
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong number of label values should panic")
+		}
+	}()
+	NewRegistry().NewCounter("test_total", "", "task").Inc()
+}
@@ -0,0 +1,118 @@
+/*
+ *
+ */
+
+package relays
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/yannh/dregsy/internal/pkg/log"
+)
+
+// Limiter limits how many tags are synced concurrently
+type Limiter interface {
+	// Acquire blocks until another tag may be synced, and returns the function
+	// for releasing the acquired slot once done
+	Acquire() func()
+}
+
+// Interrupted is returned by Relay.Sync when syncing was stopped before all
+// tags were synced
+type Interrupted struct {
+	// tags whose sync was aborted while in progress
+	Aborted []string
+	// tags whose sync was not started
+	Skipped []string
+	// set if the sync of other tags failed
+	Failed bool
+}
+
+//
+func (e *Interrupted) Error() string {
+	return fmt.Sprintf("sync interrupted, %d tag(s) aborted, %d not started",
+		len(e.Aborted), len(e.Skipped))
+}
+
+// SyncTags calls syncTag for each of tags, with a logger derived from Log that
+// carries the tag as a field. Without a Limiter, this happens one after the
+// other, logging straight away. Otherwise, the calls run concurrently as far
+// as the Limiter permits. Each of them then gets a buffered logger, which is
+// flushed when the call is done, so that the log output stays grouped per
+// tag. syncTag returns true if syncing the tag failed,
+// and is expected to have logged the reason. SyncTags returns true if any of
+// the calls failed. Once Stop is closed or ctx is cancelled, no further calls
+// are started, and an Interrupted error is returned as well, listing the tags
+// that were not synced.
+func (o *SyncOptions) SyncTags(ctx context.Context, tags []string,
+	syncTag func(tag string, lg *log.Logger) bool) (bool, *Interrupted) {
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	errs := false
+	interrupted := &Interrupted{}
+
+	done := func(tag string, failed bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failed && ctx.Err() != nil {
+			interrupted.Aborted = append(interrupted.Aborted, tag)
+		} else if failed {
+			errs = true
+		}
+	}
+
+	stopped := func() bool {
+		if ctx.Err() != nil {
+			return true
+		}
+		select {
+		case <-o.Stop:
+			return true
+		default:
+			return false
+		}
+	}
+
+	for ix, tag := range tags {
+
+		if stopped() {
+			interrupted.Skipped = tags[ix:]
+			break
+		}
+
+		lg := o.Log.With(log.Fields{"tag": tag})
+
+		if o.Limiter == nil {
+			done(tag, syncTag(tag, lg))
+			continue
+		}
+
+		release := o.Limiter.Acquire()
+		// stopping may have happened while waiting
+		if stopped() {
+			release()
+			interrupted.Skipped = tags[ix:]
+			break
+		}
+
+		wg.Add(1)
+		go func(tag string, lg *log.Logger) {
+			defer wg.Done()
+			defer release()
+			failed := syncTag(tag, lg)
+			lg.Flush()
+			done(tag, failed)
+		}(tag, lg.Buffered())
+	}
+
+	wg.Wait()
+
+	if len(interrupted.Aborted) == 0 && len(interrupted.Skipped) == 0 {
+		return errs, nil
+	}
+	interrupted.Failed = errs
+	return errs, interrupted
+}
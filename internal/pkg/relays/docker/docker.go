@@ -111,8 +111,9 @@ func (dc *dockerClient) open() error {
 func (dc *dockerClient) ping(attempts int, sleep time.Duration) (
 	types.Ping, error) {
 	var err error
+	var res types.Ping
 	for i := 1; ; i++ {
-		if res, err := dc.client.Ping(context.Background()); err == nil {
+		if res, err = dc.client.Ping(context.Background()); err == nil {
 			return res, err
 		}
 		if i >= attempts {
@@ -194,47 +195,92 @@ func match(filterRepo, filterPath, filterTag, ref string) (bool, error) {
 }
 
 //
-func (dc *dockerClient) pullImage(ref string, allTags bool, auth string,
-	verbose bool) error {
+func (dc *dockerClient) pullImage(ctx context.Context, ref string,
+	allTags bool, auth, platform string, verbose bool) error {
 	opts := &types.ImagePullOptions{
 		All:          allTags,
 		RegistryAuth: auth,
+		Platform:     platform,
 	}
-	rc, err := dc.client.ImagePull(context.Background(), ref, *opts)
-	return dc.handleLog(rc, err, verbose)
+	rc, err := dc.client.ImagePull(ctx, ref, *opts)
+	return dc.handleLog(rc, err, nil, verbose)
 }
 
-//
-func (dc *dockerClient) pushImage(image string, allTags bool, auth string,
-	verbose bool) error {
+// pushImage pushes image, writing progress to out, or the client's writer if
+// out is nil
+func (dc *dockerClient) pushImage(ctx context.Context, image string,
+	allTags bool, auth string, out io.Writer, verbose bool) error {
 
 	opts := &types.ImagePushOptions{
 		All:          allTags,
 		RegistryAuth: auth,
 	}
-	rc, err := dc.client.ImagePush(context.Background(), image, *opts)
-	return dc.handleLog(rc, err, verbose)
+	rc, err := dc.client.ImagePush(ctx, image, *opts)
+	return dc.handleLog(rc, err, out, verbose)
+}
+
+//
+func (dc *dockerClient) imageCreated(ref string) (time.Time, error) {
+	info, _, err := dc.client.ImageInspectWithRaw(context.Background(), ref)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, info.Created)
+}
+
+// pushedDigest returns the digest with which the local image ref was last
+// pushed to repository trgtRef, or an empty string if it hasn't been pushed
+// there. The daemon records this digest in the image's repo digests, so if the
+// target tag still has this digest, it is unchanged.
+func (dc *dockerClient) pushedDigest(ref, trgtRef string) (string, error) {
+
+	info, _, err := dc.client.ImageInspectWithRaw(context.Background(), ref)
+	if err != nil {
+		return "", err
+	}
+
+	trgt, err := reference.ParseNormalizedNamed(trgtRef)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rd := range info.RepoDigests {
+		named, err := reference.ParseNormalizedNamed(rd)
+		if err != nil {
+			continue
+		}
+		if canonical, ok := named.(reference.Canonical); ok &&
+			named.Name() == trgt.Name() {
+			return string(canonical.Digest()), nil
+		}
+	}
+
+	return "", nil
 }
 
 //
-func (dc *dockerClient) tagImage(source, target string) error {
-	return dc.client.ImageTag(context.Background(), source, target)
+func (dc *dockerClient) tagImage(ctx context.Context, source,
+	target string) error {
+	return dc.client.ImageTag(ctx, source, target)
 }
 
 //
 func (dc *dockerClient) handleLog(rc io.ReadCloser, err error,
-	verbose bool) error {
+	out io.Writer, verbose bool) error {
 
 	if err != nil {
 		return err
 	}
 	defer rc.Close()
-	out := dc.wrOut
+	if out == nil {
+		out = dc.wrOut
+	}
+	isStdout := out == os.Stdout
 	if !verbose {
 		out = ioutil.Discard
 	}
 	terminalFd := os.Stdout.Fd()
-	isTerminal := dc.wrOut == os.Stdout && terminal.IsTerminal(int(terminalFd))
+	isTerminal := isStdout && terminal.IsTerminal(int(terminalFd))
 	return jsonmessage.DisplayJSONMessagesStream(
 		rc, out, terminalFd, isTerminal, nil)
 }
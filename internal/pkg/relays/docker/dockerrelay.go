@@ -0,0 +1,269 @@
+/*
+ *
+ */
+
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/relays"
+)
+
+const RelayID = "docker"
+
+const pingAttempts = 12
+const pingSleep = 5 * time.Second
+
+//
+type RelayConfig struct {
+	DockerHost string `yaml:"dockerhost"`
+	APIVersion string `yaml:"api-version"`
+}
+
+//
+type DockerRelay struct {
+	client *dockerClient
+}
+
+//
+func NewDockerRelay(conf *RelayConfig, out io.Writer) (*DockerRelay, error) {
+
+	relay := &DockerRelay{}
+
+	dockerHost := client.DefaultDockerHost
+	apiVersion := ""
+
+	if conf != nil {
+		if conf.DockerHost != "" {
+			dockerHost = conf.DockerHost
+		}
+		if conf.APIVersion != "" {
+			apiVersion = conf.APIVersion
+		}
+	}
+
+	cli, err := newClient(dockerHost, apiVersion, out)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Docker client: %v", err)
+	}
+	relay.client = cli
+
+	return relay, nil
+}
+
+//
+func (r *DockerRelay) Prepare() error {
+	res, err := r.client.ping(pingAttempts, pingSleep)
+	if err != nil {
+		return fmt.Errorf("cannot ping Docker server: %v", err)
+	}
+	// without an explicitly configured API version, go with what the daemon
+	// supports
+	r.client.client.NegotiateAPIVersionPing(res)
+	log.Info("Docker daemon API version %s", r.client.client.ClientVersion())
+	log.Info("%s relay ready", RelayID)
+	return nil
+}
+
+//
+func (r *DockerRelay) Dispose() {
+	log.Error(r.client.close())
+}
+
+//
+func (r *DockerRelay) Sync(ctx context.Context,
+	opt *relays.SyncOptions) error {
+
+	skipTLSVerify := opt.SrcSkipTLSVerify
+	for _, trgt := range opt.Targets {
+		skipTLSVerify = skipTLSVerify || trgt.SkipTLSVerify
+	}
+	if skipTLSVerify {
+		opt.Log.Warning("skipping TLS verification needs to be configured " +
+			"in the Docker daemon, ignoring 'skip-tls-verify' setting")
+	}
+
+	if opt.Prune {
+		return fmt.Errorf("%s relay cannot prune target tags", RelayID)
+	}
+
+	platform := ""
+	if opt.AllPlatforms() || len(opt.Platforms) > 1 {
+		return fmt.Errorf("%s relay can only sync a single platform", RelayID)
+	} else if len(opt.Platforms) == 1 {
+		platform = opt.Platforms[0]
+	}
+
+	srcTags, err := r.pullSourceTags(ctx, opt, platform)
+	if err != nil {
+		return err
+	}
+
+	tags, err := opt.FilterTags(srcTags, func(tag string) (time.Time, error) {
+		return r.client.imageCreated(fmt.Sprintf("%s:%s", opt.SrcRef, tag))
+	})
+	if err != nil {
+		return err
+	}
+
+	// the daemon holds the pulled images, so all targets are pushed from there
+	errs, interrupted := opt.SyncTags(ctx, tags, func(tag string,
+		lg *log.Logger) bool {
+
+		// with a buffered logger, push progress goes there as well
+		var out io.Writer
+		if lg.IsBuffered() {
+			out = lg
+		}
+
+		errs := false
+		for _, trgt := range opt.Targets {
+
+			if opt.SkipExistingTags &&
+				r.targetTagExists(ctx, trgt.Ref, tag, trgt.Auth) {
+				lg.With(log.Fields{"target": trgt.Ref}).Info(
+					"skipping tag: already present in destination")
+				opt.TagDone(tag, trgt, relays.TagExists, nil, nil)
+				continue
+			}
+
+			if opt.SkipUnchangedTags && !relays.TagChanged(lg, tag,
+				func(tag string) (string, error) {
+					return r.client.pushedDigest(
+						fmt.Sprintf("%s:%s", opt.SrcRef, tag), trgt.Ref)
+				},
+				func(tag string) (string, error) {
+					return r.targetDigest(ctx, trgt.Ref, tag, trgt.Auth), nil
+				}) {
+				opt.TagDone(tag, trgt, relays.TagUnchanged, nil, nil)
+				continue
+			}
+
+			if opt.Planned(lg, tag, trgt) {
+				continue
+			}
+			opt.LogSyncing(lg, trgt)
+			start := time.Now()
+			err := opt.Retry.Do(ctx, lg, "syncing tag", func() error {
+				return r.syncTag(ctx, opt.SrcRef, trgt.Ref, tag, trgt.Auth,
+					out, opt.Verbose)
+			})
+			stats := &relays.TagStats{Duration: time.Since(start)}
+			opt.TagDone(tag, trgt, relays.CopyResult(err), stats, err)
+			if lg.With(log.Fields{"target": trgt.Ref}).Error(err) {
+				errs = true
+				continue
+			}
+			opt.LogSynced(lg, trgt, stats.Duration)
+		}
+		return errs
+	})
+
+	if interrupted != nil {
+		return interrupted
+	}
+
+	if errs {
+		return fmt.Errorf("errors during sync")
+	}
+
+	return nil
+}
+
+// pullSourceTags pulls the source image into the Docker daemon and returns
+// the list of tags available for it. When only literal tags are requested,
+// only those are pulled. Otherwise, all tags of the source image are pulled,
+// since the daemon cannot list tags in a remote registry.
+func (r *DockerRelay) pullSourceTags(ctx context.Context,
+	opt *relays.SyncOptions, platform string) ([]string, error) {
+
+	srcRef := opt.SrcRef
+	srcAuth := opt.SrcAuth
+	verbose := opt.Verbose
+
+	if !opt.ListAllTags() {
+		opt.Log.Info("pulling source image")
+		for _, tag := range opt.Tags {
+			ref := fmt.Sprintf("%s:%s", srcRef, tag)
+			if err := opt.Retry.Do(ctx, opt.Log, "pulling source image",
+				func() error {
+					return r.client.pullImage(
+						ctx, ref, false, srcAuth, platform, verbose)
+				}); err != nil {
+				return nil, fmt.Errorf(
+					"error pulling source image '%s': %v", ref, err)
+			}
+		}
+		return opt.Tags, nil
+	}
+
+	opt.Log.Info("pulling all tags of source image")
+	if err := opt.Retry.Do(ctx, opt.Log, "pulling source image", func() error {
+		return r.client.pullImage(
+			ctx, srcRef, true, srcAuth, platform, verbose)
+	}); err != nil {
+		return nil, fmt.Errorf(
+			"error pulling source image '%s': %v", srcRef, err)
+	}
+
+	imgs, err := r.client.listImages(srcRef)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error listing source image '%s': %v", srcRef, err)
+	}
+
+	var ret []string
+	for _, img := range imgs {
+		ret = append(ret, img.Tags...)
+	}
+	return ret, nil
+}
+
+//
+func (r *DockerRelay) syncTag(ctx context.Context, srcRef, trgtRef, tag,
+	trgtAuth string, out io.Writer, verbose bool) error {
+
+	src := fmt.Sprintf("%s:%s", srcRef, tag)
+	trgt := fmt.Sprintf("%s:%s", trgtRef, tag)
+
+	if err := r.client.tagImage(ctx, src, trgt); err != nil {
+		return fmt.Errorf("error tagging '%s' as '%s': %v", src, trgt, err)
+	}
+
+	if err := r.client.pushImage(ctx,
+		trgt, false, trgtAuth, out, verbose); err != nil {
+		return fmt.Errorf("error pushing target image '%s': %v", trgt, err)
+	}
+
+	return nil
+}
+
+// targetTagExists checks via the daemon's distribution API whether tag is
+// already present in the target registry. Any error is treated as the tag not
+// being present, so that it will be synced.
+func (r *DockerRelay) targetTagExists(ctx context.Context, trgtRef, tag,
+	trgtAuth string) bool {
+	_, err := r.client.client.DistributionInspect(ctx,
+		fmt.Sprintf("%s:%s", trgtRef, tag), trgtAuth)
+	return err == nil
+}
+
+// targetDigest returns the digest of tag in the target registry, as reported
+// by the daemon's distribution API. Same as with targetTagExists, any error is
+// treated as the tag not being present, and an empty digest is returned.
+func (r *DockerRelay) targetDigest(ctx context.Context, trgtRef, tag,
+	trgtAuth string) string {
+	res, err := r.client.client.DistributionInspect(ctx,
+		fmt.Sprintf("%s:%s", trgtRef, tag), trgtAuth)
+	if err != nil {
+		return ""
+	}
+	return string(res.Descriptor.Digest)
+}
@@ -0,0 +1,103 @@
+/*
+ *
+ */
+
+package relays
+
+import (
+	"time"
+)
+
+// TagResult is the outcome of syncing a tag to a target
+type TagResult int
+
+const (
+	// the tag was copied to the target
+	TagCopied TagResult = iota
+	// the tag was not synced, since it's already present in the target
+	TagExists
+	// the tag was not synced, since it's unchanged in the target
+	TagUnchanged
+	// syncing the tag failed
+	TagFailed
+	// the tag would be copied to the target, if this wasn't a dry run
+	TagPlanned
+	// the tag was deleted from the target during pruning, or with a dry run,
+	// would be
+	TagPruned
+)
+
+//
+func (r TagResult) String() string {
+	switch r {
+	case TagCopied:
+		return "copied"
+	case TagExists:
+		return "exists"
+	case TagUnchanged:
+		return "unchanged"
+	case TagFailed:
+		return "failed"
+	case TagPlanned:
+		return "planned"
+	case TagPruned:
+		return "pruned"
+	}
+	return "unknown"
+}
+
+// CopyResult returns the result for a tag whose copy finished with err
+func CopyResult(err error) TagResult {
+	if err != nil {
+		return TagFailed
+	}
+	return TagCopied
+}
+
+// TagStats gives details about copying a tag, as far as the relay knows
+// them; fields that are not known are left at 0
+type TagStats struct {
+	// time taken for copying
+	Duration time.Duration
+	// number of bytes transferred
+	Bytes int64
+}
+
+// Observer gets notified about the progress of a sync, e.g. for collecting
+// metrics; it needs to be safe for concurrent use
+type Observer interface {
+	// TagsFiltered is called once the tags to sync have been selected from
+	// the tags listed in the source
+	TagsFiltered(listed, selected []string)
+	// TagDone is called once syncing tag to trgt is done, with stats if it
+	// was copied, and the error if it failed; it's also called for each tag
+	// pruned from trgt
+	TagDone(tag string, trgt *Target, res TagResult, stats *TagStats,
+		err error)
+}
+
+// Observers passes all notifications on to each of its observers
+type Observers []Observer
+
+//
+func (obs Observers) TagsFiltered(listed, selected []string) {
+	for _, o := range obs {
+		o.TagsFiltered(listed, selected)
+	}
+}
+
+//
+func (obs Observers) TagDone(tag string, trgt *Target, res TagResult,
+	stats *TagStats, err error) {
+	for _, o := range obs {
+		o.TagDone(tag, trgt, res, stats, err)
+	}
+}
+
+// TagDone notifies the Observer, if any, that syncing tag to trgt is done
+func (o *SyncOptions) TagDone(tag string, trgt *Target, res TagResult,
+	stats *TagStats, err error) {
+	if o.Observer != nil {
+		o.Observer.TagDone(tag, trgt, res, stats, err)
+	}
+}
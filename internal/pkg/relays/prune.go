@@ -0,0 +1,148 @@
+/*
+ *
+ */
+
+package relays
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/tags"
+)
+
+// Pruner is implemented by relays for deleting tags from a target repository
+type Pruner interface {
+	// ListTags returns all tags present in the target repository
+	ListTags(ctx context.Context) ([]string, error)
+	// Digest returns the manifest digest of tag in the target repository
+	Digest(ctx context.Context, tag string) (string, error)
+	// Delete deletes the manifest with digest, to which tag points, from the
+	// target repository
+	Delete(ctx context.Context, tag, digest string) error
+}
+
+// PruneTarget deletes all tags from the target repository that are neither in
+// keep, nor match any of the PruneProtect patterns. Since registries delete
+// manifests, not tags, a tag is also not deleted when its manifest is still
+// referenced by a tag that stays. As a safety net, nothing is deleted if keep
+// is empty, since this is more likely a mistake in the tag filters, or a
+// problem with the source, than the intended outcome.
+func (o *SyncOptions) PruneTarget(ctx context.Context, trgt *Target,
+	keep []string, p Pruner) error {
+
+	lg := o.Log.With(log.Fields{"target": trgt.Ref})
+	dryRun := o.PruneDryRun || o.DryRun
+
+	if len(keep) == 0 {
+		lg.Warning("no tags to keep in target, not pruning")
+		return nil
+	}
+
+	present, err := p.ListTags(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing target tags for pruning: %v", err)
+	}
+
+	keepSet := make(map[string]bool, len(keep))
+	for _, tag := range keep {
+		keepSet[tag] = true
+	}
+
+	var candidates []string
+	for _, tag := range present {
+		if keepSet[tag] {
+			continue
+		}
+		protected, err := tags.Match(tag, o.PruneProtect, nil)
+		if err != nil {
+			return err
+		}
+		if protected {
+			lg.With(log.Fields{"tag": tag}).Info("not pruning tag: protected")
+			keepSet[tag] = true
+			continue
+		}
+		candidates = append(candidates, tag)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// digests still referenced by tags that stay
+	inUse := make(map[string]string)
+	for _, tag := range present {
+		if !keepSet[tag] {
+			continue
+		}
+		digest, err := p.Digest(ctx, tag)
+		if err != nil {
+			return fmt.Errorf(
+				"error determining digest of target tag '%s': %v", tag, err)
+		}
+		if digest != "" {
+			inUse[digest] = tag
+		}
+	}
+
+	errs := false
+	deleted := make(map[string]bool)
+
+	for _, tag := range candidates {
+
+		tlg := lg.With(log.Fields{"tag": tag})
+
+		digest, err := p.Digest(ctx, tag)
+		if err != nil {
+			errs = true
+			tlg.Error(fmt.Errorf(
+				"error determining digest of target tag: %v", err))
+			continue
+		}
+
+		if digest == "" {
+			// gone in the meantime
+			continue
+		}
+
+		if other, ok := inUse[digest]; ok {
+			tlg.Warning("not pruning tag: manifest %s still in use by "+
+				"tag '%s'", digest, other)
+			continue
+		}
+
+		if deleted[digest] {
+			if dryRun {
+				tlg.Info("would prune tag along with manifest %s (dry run)",
+					digest)
+			} else {
+				tlg.Info("pruned tag along with manifest %s", digest)
+			}
+			o.TagDone(tag, trgt, TagPruned, nil, nil)
+			continue
+		}
+
+		if dryRun {
+			tlg.Info("would prune tag, manifest %s (dry run)", digest)
+			deleted[digest] = true
+			o.TagDone(tag, trgt, TagPruned, nil, nil)
+			continue
+		}
+
+		tlg.Info("pruning tag, manifest %s", digest)
+		if err := p.Delete(ctx, tag, digest); err != nil {
+			errs = true
+			tlg.Error(fmt.Errorf("error pruning tag: %v", err))
+			continue
+		}
+		deleted[digest] = true
+		o.TagDone(tag, trgt, TagPruned, nil, nil)
+	}
+
+	if errs {
+		return fmt.Errorf("errors during pruning")
+	}
+	return nil
+}
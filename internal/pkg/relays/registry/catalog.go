@@ -0,0 +1,176 @@
+/*
+ *
+ */
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// number of repositories to request per page
+const catalogPageSize = 100
+
+// ListRepositories returns the paths of all repositories in the registry at
+// host, as far as visible to the user given with auth. Registries such as
+// Harbor restrict the catalog endpoint to admins, so if it can't be used, the
+// Harbor API is tried instead.
+func ListRepositories(ctx context.Context, host, auth string,
+	skipTLSVerify bool, certsDir string) ([]string, error) {
+
+	c, err := newClient(ctx, host, auth, skipTLSVerify, certsDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ping(); err != nil {
+		return nil, err
+	}
+
+	ret, err := c.listRepositories()
+	if err == nil || !catalogUnavailable(err) {
+		return ret, err
+	}
+
+	ret, harborErr := c.listHarborRepositories()
+	if harborErr != nil {
+		return nil, fmt.Errorf("%v; Harbor API not available either: %v",
+			err, harborErr)
+	}
+	return ret, nil
+}
+
+//
+func catalogUnavailable(err error) bool {
+	if e, ok := err.(*Error); ok {
+		switch e.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden,
+			http.StatusNotFound, http.StatusMethodNotAllowed:
+			return true
+		}
+		return e.HasCode("UNSUPPORTED")
+	}
+	return false
+}
+
+// listRepositories lists repositories via the catalog endpoint, following
+// pagination links
+func (c *client) listRepositories() ([]string, error) {
+
+	var ret []string
+	next := c.url("/v2/_catalog")
+	next.RawQuery = fmt.Sprintf("n=%d", catalogPageSize)
+
+	for next != nil {
+
+		req, err := c.newRequest(http.MethodGet, next.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.do(req, catalogScope)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = newError("listing repositories", resp)
+			drain(resp)
+			return nil, err
+		}
+
+		var cat struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&cat)
+		drain(resp)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding catalog: %v", err)
+		}
+		ret = append(ret, cat.Repositories...)
+
+		next = nextLink(resp)
+	}
+
+	return ret, nil
+}
+
+// listHarborRepositories lists the repositories of all projects visible to
+// the user via the Harbor API
+func (c *client) listHarborRepositories() ([]string, error) {
+
+	var projects []struct {
+		Name string `json:"name"`
+	}
+	if err := c.getHarborList("/api/v2.0/projects", &projects); err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, p := range projects {
+		var repos []struct {
+			Name string `json:"name"`
+		}
+		if err := c.getHarborList(fmt.Sprintf(
+			"/api/v2.0/projects/%s/repositories", p.Name), &repos); err != nil {
+			return nil, err
+		}
+		for _, r := range repos {
+			ret = append(ret, r.Name)
+		}
+	}
+
+	return ret, nil
+}
+
+// getHarborList retrieves all pages of a list from the Harbor API at path,
+// and appends the items to list, which needs to be a pointer to a slice.
+// Harbor's API uses basic auth, not the registry's token auth.
+func (c *client) getHarborList(path string, list interface{}) error {
+
+	next := c.url(path)
+	next.RawQuery = fmt.Sprintf("page_size=%d", catalogPageSize)
+
+	var items []json.RawMessage
+
+	for next != nil {
+
+		req, err := c.newRequest(http.MethodGet, next.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		if c.creds != nil {
+			req.SetBasicAuth(c.creds.Username, c.creds.Password)
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = newError("listing via Harbor API", resp)
+			drain(resp)
+			return err
+		}
+
+		var page []json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		drain(resp)
+		if err != nil {
+			return fmt.Errorf("error decoding Harbor API response: %v", err)
+		}
+		items = append(items, page...)
+
+		next = nextLink(resp)
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, list)
+}
@@ -0,0 +1,714 @@
+/*
+ *
+ */
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const dockerHubHost = "docker.io"
+const dockerHubEndpoint = "registry-1.docker.io"
+
+const requestTimeout = 30 * time.Second
+
+const catalogScope = "registry:catalog:*"
+
+//
+type creds struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// client talks to a single registry via the distribution HTTP API
+type client struct {
+	ctx       context.Context
+	endpoint  *url.URL
+	creds     *creds
+	http      *http.Client
+	insecure  bool
+	challenge *challenge
+	tokens    map[string]string
+	mutex     sync.Mutex
+}
+
+// newClient creates a client for host; all its requests are bound to ctx
+func newClient(ctx context.Context, host, auth string, skipTLSVerify bool,
+	certsDir string) (*client, error) {
+
+	if host == "" || host == dockerHubHost || host == "index."+dockerHubHost {
+		host = dockerHubEndpoint
+	}
+
+	cr, err := decodeJSONAuth(auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth for '%s': %v", host, err)
+	}
+
+	tlsConf, err := tlsConfig(host, skipTLSVerify, certsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{
+		ctx:      ctx,
+		endpoint: &url.URL{Scheme: "https", Host: host},
+		creds:    cr,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				TLSClientConfig:       tlsConf,
+				TLSHandshakeTimeout:   requestTimeout,
+				ResponseHeaderTimeout: requestTimeout,
+			},
+		},
+		insecure: skipTLSVerify,
+		tokens:   make(map[string]string),
+	}
+
+	return c, nil
+}
+
+// ping checks the registry's API base endpoint and records the
+// authentication challenge, if any. When TLS verification is skipped and the
+// registry does not speak TLS at all, ping falls back to plain HTTP.
+func (c *client) ping() error {
+
+	get := func() (*http.Response, error) {
+		req, err := c.newRequest(http.MethodGet, c.url("/v2/").String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return c.http.Do(req)
+	}
+
+	resp, err := get()
+
+	if err != nil && c.insecure && c.endpoint.Scheme == "https" {
+		c.endpoint.Scheme = "http"
+		resp, err = get()
+	}
+
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		c.challenge = parseChallenge(resp.Header.Get("WWW-Authenticate"))
+		return nil
+	}
+
+	return newError("ping", resp)
+}
+
+//
+func (c *client) newRequest(method, url string, body io.Reader) (
+	*http.Request, error) {
+	return http.NewRequestWithContext(c.ctx, method, url, body)
+}
+
+//
+func (c *client) url(path string) *url.URL {
+	u := *c.endpoint
+	u.Path = path
+	return &u
+}
+
+// do sends req with authorization for scope. If the registry responds with
+// 401, the authentication challenge is renewed and the request retried once,
+// provided its body can be replayed.
+func (c *client) do(req *http.Request, scope string) (*http.Response, error) {
+
+	if err := c.authorize(req, scope); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized ||
+		(req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+
+	ch := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	drain(resp)
+
+	c.mutex.Lock()
+	c.challenge = ch
+	delete(c.tokens, scope)
+	c.mutex.Unlock()
+
+	if req.GetBody != nil {
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.authorize(req, scope); err != nil {
+		return nil, err
+	}
+
+	return c.http.Do(req)
+}
+
+//
+func (c *client) authorize(req *http.Request, scope string) error {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.challenge == nil {
+		return nil
+	}
+
+	switch c.challenge.scheme {
+
+	case "basic":
+		if c.creds != nil {
+			req.SetBasicAuth(c.creds.Username, c.creds.Password)
+		}
+
+	case "bearer":
+		token, ok := c.tokens[scope]
+		if !ok {
+			var err error
+			if token, err = c.fetchToken(scope); err != nil {
+				return err
+			}
+			c.tokens[scope] = token
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	return nil
+}
+
+//
+func (c *client) fetchToken(scope string) (string, error) {
+
+	realm, err := url.Parse(c.challenge.params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf(
+			"invalid token realm '%s'", c.challenge.params["realm"])
+	}
+
+	q := realm.Query()
+	if service := c.challenge.params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	for _, s := range strings.Fields(scope) {
+		q.Add("scope", s)
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := c.newRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.creds != nil {
+		req.SetBasicAuth(c.creds.Username, c.creds.Password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newError("token request", resp)
+	}
+
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("error decoding token response: %v", err)
+	}
+
+	if tr.Token != "" {
+		return tr.Token, nil
+	}
+	return tr.AccessToken, nil
+}
+
+//
+func (c *client) listTags(repo string) ([]string, error) {
+
+	var ret []string
+	next := c.url(fmt.Sprintf("/v2/%s/tags/list", repo))
+
+	for next != nil {
+
+		req, err := c.newRequest(http.MethodGet, next.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.do(req, pullScope(repo))
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err = newError("listing tags", resp)
+			drain(resp)
+			return nil, err
+		}
+
+		var tl struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&tl)
+		drain(resp)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding tag list: %v", err)
+		}
+		ret = append(ret, tl.Tags...)
+
+		next = nextLink(resp)
+	}
+
+	return ret, nil
+}
+
+//
+func (c *client) getManifest(repo, ref string) (*manifest, error) {
+
+	req, err := c.newRequest(http.MethodGet,
+		c.url(fmt.Sprintf("/v2/%s/manifests/%s", repo, ref)).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(supportedManifestTypes, ", "))
+
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return nil, err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newError("fetching manifest", resp)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseManifest(data, resp.Header.Get("Content-Type"))
+}
+
+// manifestDigest returns the digest of the manifest for ref as reported by
+// the registry, or an empty string if there is no such manifest
+func (c *client) manifestDigest(repo, ref string) (string, error) {
+
+	req, err := c.newRequest(http.MethodHead,
+		c.url(fmt.Sprintf("/v2/%s/manifests/%s", repo, ref)).String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join(supportedManifestTypes, ", "))
+
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return "", err
+	}
+	defer drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", newError("checking manifest", resp)
+	}
+
+	// the digest header is optional, so fall back to computing it ourselves
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	m, err := c.getManifest(repo, ref)
+	if err != nil {
+		return "", err
+	}
+	return m.digest, nil
+}
+
+// deleteManifest deletes the manifest with digest, and with it all tags
+// pointing to it; the registry needs to have deletion enabled for this
+func (c *client) deleteManifest(repo, digest string) error {
+
+	req, err := c.newRequest(http.MethodDelete,
+		c.url(fmt.Sprintf("/v2/%s/manifests/%s", repo, digest)).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req, deleteScope(repo))
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusAccepted &&
+		resp.StatusCode != http.StatusOK {
+		return newError("deleting manifest", resp)
+	}
+	return nil
+}
+
+//
+func (c *client) putManifest(repo, ref string, m *manifest) error {
+
+	req, err := c.newRequest(http.MethodPut,
+		c.url(fmt.Sprintf("/v2/%s/manifests/%s", repo, ref)).String(),
+		bytes.NewReader(m.raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", m.MediaType)
+
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusCreated {
+		return newError("pushing manifest", resp)
+	}
+	return nil
+}
+
+//
+func (c *client) blobExists(repo, digest string) (bool, error) {
+
+	req, err := c.newRequest(http.MethodHead,
+		c.url(fmt.Sprintf("/v2/%s/blobs/%s", repo, digest)).String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return false, err
+	}
+	defer drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, newError("checking blob", resp)
+}
+
+//
+func (c *client) getBlob(repo, digest string) (io.ReadCloser, error) {
+
+	req, err := c.newRequest(http.MethodGet,
+		c.url(fmt.Sprintf("/v2/%s/blobs/%s", repo, digest)).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer drain(resp)
+		return nil, newError("fetching blob", resp)
+	}
+	return resp.Body, nil
+}
+
+// mountBlob tries to mount a blob from another repository in the same
+// registry. If the registry does not support mounting, it starts a regular
+// upload instead, and the returned location is where to send the blob.
+func (c *client) mountBlob(repo, digest, from string) (
+	mounted bool, location *url.URL, err error) {
+
+	u := c.url(fmt.Sprintf("/v2/%s/blobs/uploads/", repo))
+	q := u.Query()
+	q.Set("mount", digest)
+	q.Set("from", from)
+	u.RawQuery = q.Encode()
+
+	return c.startUpload(u, fmt.Sprintf("%s %s", pushScope(repo), pullScope(from)))
+}
+
+//
+func (c *client) uploadBlob(repo string, desc *descriptor,
+	blob io.Reader) error {
+
+	_, location, err := c.startUpload(
+		c.url(fmt.Sprintf("/v2/%s/blobs/uploads/", repo)), pushScope(repo))
+	if err != nil {
+		return err
+	}
+	return c.finishUpload(repo, location, desc, blob)
+}
+
+//
+func (c *client) startUpload(u *url.URL, scope string) (
+	mounted bool, location *url.URL, err error) {
+
+	req, err := c.newRequest(http.MethodPost, u.String(), nil)
+	if err != nil {
+		return false, nil, err
+	}
+
+	resp, err := c.do(req, scope)
+	if err != nil {
+		return false, nil, err
+	}
+	defer drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil, nil
+	case http.StatusAccepted:
+		location, err = resp.Request.URL.Parse(resp.Header.Get("Location"))
+		return false, location, err
+	}
+	return false, nil, newError("starting blob upload", resp)
+}
+
+//
+func (c *client) finishUpload(repo string, location *url.URL,
+	desc *descriptor, blob io.Reader) error {
+
+	u := *location
+	q := u.Query()
+	q.Set("digest", desc.Digest)
+	u.RawQuery = q.Encode()
+
+	req, err := c.newRequest(http.MethodPut, u.String(), blob)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = desc.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+
+	if resp.StatusCode != http.StatusCreated {
+		return newError("uploading blob", resp)
+	}
+	return nil
+}
+
+//
+func (c *client) sameRegistry(other *client) bool {
+	return c.endpoint.String() == other.endpoint.String()
+}
+
+/* ----------------------------------------------------------------------------
+ * helpers
+ */
+
+//
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+//
+//	Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+//
+func parseChallenge(header string) *challenge {
+
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil
+	}
+
+	ch := &challenge{params: make(map[string]string)}
+
+	ix := strings.Index(header, " ")
+	if ix == -1 {
+		ch.scheme = strings.ToLower(header)
+		return ch
+	}
+	ch.scheme = strings.ToLower(header[:ix])
+	rest := header[ix+1:]
+
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				val, rest = rest[1:], ""
+			} else {
+				val, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end == -1 {
+				val, rest = rest, ""
+			} else {
+				val, rest = rest[:end], rest[end+1:]
+			}
+		}
+		ch.params[key] = strings.TrimSpace(val)
+	}
+
+	return ch
+}
+
+// nextLink returns the URL from a pagination Link header, or nil if there is
+// no next page
+func nextLink(resp *http.Response) *url.URL {
+	link := resp.Header.Get("Link")
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start == -1 || end < start || !strings.Contains(link, `rel="next"`) {
+		return nil
+	}
+	next, err := resp.Request.URL.Parse(link[start+1 : end])
+	if err != nil {
+		return nil
+	}
+	return next
+}
+
+//
+func pullScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull", repo)
+}
+
+//
+func pushScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull,push", repo)
+}
+
+//
+func deleteScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull,push,delete", repo)
+}
+
+//
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+//
+func decodeJSONAuth(authBase64 string) (*creds, error) {
+
+	if authBase64 == "" {
+		return nil, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(authBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret creds
+	if err := json.Unmarshal(decoded, &ret); err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+// tlsConfig sets up TLS for host, using the same certs dir layout as the
+// skopeo relay: CA certs (*.crt), and client.cert/client.key for mutual TLS,
+// in a folder named after the registry host, without port
+func tlsConfig(host string, skipTLSVerify bool, certsDir string) (
+	*tls.Config, error) {
+
+	conf := &tls.Config{InsecureSkipVerify: skipTLSVerify}
+
+	if certsDir == "" {
+		return conf, nil
+	}
+
+	dir := filepath.Join(certsDir, withoutPort(host))
+
+	cas, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	if len(cas) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, ca := range cas {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			pool.AppendCertsFromPEM(pem)
+		}
+		conf.RootCAs = pool
+	}
+
+	cert := filepath.Join(dir, "client.cert")
+	key := filepath.Join(dir, "client.key")
+	if _, err := os.Stat(cert); err == nil {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error loading client cert & key from '%s': %v", dir, err)
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+
+	return conf, nil
+}
+
+//
+func withoutPort(host string) string {
+	ix := strings.Index(host, ":")
+	if ix == -1 {
+		return host
+	}
+	return host[:ix]
+}
@@ -0,0 +1,94 @@
+/*
+ *
+ */
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/yannh/dregsy/internal/pkg/relays"
+)
+
+//
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is returned for any request the registry answered with an unexpected
+// status. Errors holds the error details from the response body, if the
+// registry provided them in the format defined by the distribution spec.
+type Error struct {
+	Op         string
+	URL        string
+	StatusCode int
+	Errors     []errorDetail
+}
+
+//
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s '%s': %d %s", e.Op, e.URL, e.StatusCode,
+		http.StatusText(e.StatusCode))
+	if len(e.Errors) > 0 {
+		details := make([]string, 0, len(e.Errors))
+		for _, d := range e.Errors {
+			details = append(details, fmt.Sprintf("%s: %s", d.Code, d.Message))
+		}
+		msg = fmt.Sprintf("%s (%s)", msg, strings.Join(details, "; "))
+	}
+	return msg
+}
+
+// HasCode returns true if any of the error details carries the given
+// distribution error code, e.g. MANIFEST_UNKNOWN.
+func (e *Error) HasCode(code string) bool {
+	for _, d := range e.Errors {
+		if d.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Retryable implements relays.Retryable
+func (e *Error) Retryable() bool {
+	return relays.IsRetryableStatus(e.StatusCode)
+}
+
+//
+func newError(op string, resp *http.Response) *Error {
+
+	ret := &Error{
+		Op:         op,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil || len(body) == 0 {
+		return ret
+	}
+
+	var details struct {
+		Errors []errorDetail `json:"errors"`
+	}
+	if json.Unmarshal(body, &details) == nil {
+		ret.Errors = details.Errors
+	}
+
+	return ret
+}
+
+//
+func isNotFound(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+/*
+ *
+ */
+
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/yannh/dregsy/internal/pkg/relays"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	mediaTypeOCIForeignLayer    = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+)
+
+var supportedManifestTypes = []string{
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+}
+
+//
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+//
+func (p *platform) String() string {
+	if p == nil {
+		return "unknown"
+	}
+	ret := fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	if p.Variant != "" {
+		ret = fmt.Sprintf("%s/%s", ret, p.Variant)
+	}
+	return ret
+}
+
+//
+type descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	URLs      []string  `json:"urls,omitempty"`
+	Platform  *platform `json:"platform,omitempty"`
+}
+
+//
+func (d *descriptor) isForeign() bool {
+	return d.MediaType == mediaTypeDockerForeignLayer ||
+		d.MediaType == mediaTypeOCIForeignLayer
+}
+
+// manifest is either an image manifest or a manifest list/index. The raw
+// bytes are kept as received, since re-encoding would change the digest.
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        *descriptor  `json:"config,omitempty"`
+	Layers        []descriptor `json:"layers,omitempty"`
+	Manifests     []descriptor `json:"manifests,omitempty"`
+	//
+	raw    []byte
+	digest string
+}
+
+//
+func parseManifest(data []byte, contentType string) (*manifest, error) {
+
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %v", err)
+	}
+
+	if m.SchemaVersion != 2 {
+		return nil, fmt.Errorf(
+			"manifest schema version %d not supported", m.SchemaVersion)
+	}
+
+	// OCI manifests may omit the media type, so go with the content type
+	if m.MediaType == "" {
+		m.MediaType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	}
+	if m.MediaType == "" || m.MediaType == "application/json" {
+		if m.Manifests != nil {
+			m.MediaType = mediaTypeOCIIndex
+		} else {
+			m.MediaType = mediaTypeOCIManifest
+		}
+	}
+
+	supported := false
+	for _, t := range supportedManifestTypes {
+		if m.MediaType == t {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return nil, fmt.Errorf("manifest type '%s' not supported", m.MediaType)
+	}
+
+	m.raw = data
+	m.digest = fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+
+	return m, nil
+}
+
+//
+func (m *manifest) isIndex() bool {
+	return m.MediaType == mediaTypeDockerManifestList ||
+		m.MediaType == mediaTypeOCIIndex
+}
+
+// blobs returns the config and layer blobs referenced by an image manifest
+func (m *manifest) blobs() []descriptor {
+	var ret []descriptor
+	if m.Config != nil {
+		ret = append(ret, *m.Config)
+	}
+	return append(ret, m.Layers...)
+}
+
+// platformManifest selects the manifest matching the platform dregsy is
+// running on from a manifest list, same as skopeo does when not copying all
+// images of a list
+func (m *manifest) platformManifest() (*descriptor, error) {
+	own := &relays.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	for ix := range m.Manifests {
+		if m.Manifests[ix].matches(own) {
+			return &m.Manifests[ix], nil
+		}
+	}
+	return nil, fmt.Errorf(
+		"no manifest for platform %s in manifest list", own)
+}
+
+// filterIndex returns a manifest list containing only the manifests for the
+// given platforms. If all manifests are kept, the list is returned unchanged,
+// to preserve its digest.
+func (m *manifest) filterIndex(platforms []*relays.Platform) (
+	*manifest, error) {
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(m.raw, &doc); err != nil {
+		return nil, fmt.Errorf("error decoding manifest list: %v", err)
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(doc["manifests"], &entries); err != nil {
+		return nil, fmt.Errorf("error decoding manifest list: %v", err)
+	}
+
+	var keep []json.RawMessage
+	for ix := range m.Manifests {
+		for _, p := range platforms {
+			if m.Manifests[ix].matches(p) {
+				keep = append(keep, entries[ix])
+				break
+			}
+		}
+	}
+
+	if len(keep) == 0 {
+		return nil, fmt.Errorf("none of the platforms %v in manifest list",
+			platforms)
+	}
+	if len(keep) == len(entries) {
+		return m, nil
+	}
+
+	raw, err := json.Marshal(keep)
+	if err != nil {
+		return nil, err
+	}
+	doc["manifests"] = raw
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data, m.MediaType)
+}
+
+//
+func (d *descriptor) matches(p *relays.Platform) bool {
+	return d.Platform != nil &&
+		p.Matches(d.Platform.OS, d.Platform.Architecture, d.Platform.Variant)
+}
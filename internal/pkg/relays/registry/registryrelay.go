@@ -0,0 +1,479 @@
+/*
+ *
+ */
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/relays"
+	"github.com/yannh/dregsy/internal/pkg/relays/docker"
+)
+
+const RelayID = "registry"
+
+//
+type RelayConfig struct {
+	CertsDir string `yaml:"certs-dir"`
+}
+
+// RegistryRelay copies images by talking to source and target registries
+// directly via the distribution API, without any external tool or daemon
+type RegistryRelay struct {
+	certsDir string
+}
+
+//
+func NewRegistryRelay(conf *RelayConfig) *RegistryRelay {
+	relay := &RegistryRelay{}
+	if conf != nil {
+		relay.certsDir = conf.CertsDir
+	}
+	return relay
+}
+
+//
+func (r *RegistryRelay) Prepare() error {
+	log.Info("%s relay ready", RelayID)
+	return nil
+}
+
+//
+func (r *RegistryRelay) Dispose() {
+}
+
+//
+func (r *RegistryRelay) Sync(ctx context.Context,
+	opt *relays.SyncOptions) error {
+
+	var platforms []*relays.Platform
+	if !opt.AllPlatforms() {
+		for _, p := range opt.Platforms {
+			pf, err := relays.ParsePlatform(p)
+			if err != nil {
+				return err
+			}
+			platforms = append(platforms, pf)
+		}
+	}
+
+	src, err := r.newRepo(ctx, opt.SrcRef, opt.SrcAuth, opt.SrcSkipTLSVerify)
+	if err != nil {
+		return fmt.Errorf("error connecting to source: %v", err)
+	}
+
+	var dests []*repo
+	for _, trgt := range opt.Targets {
+		dest, err := r.newRepo(ctx, trgt.Ref, trgt.Auth, trgt.SkipTLSVerify)
+		if err != nil {
+			return fmt.Errorf("error connecting to target '%s': %v",
+				trgt.Ref, err)
+		}
+		dests = append(dests, dest)
+	}
+
+	srcTags := opt.Tags
+	if opt.ListAllTags() {
+		if err = opt.Retry.Do(ctx, opt.Log, "listing image tags", func() error {
+			var err error
+			srcTags, err = src.client.listTags(src.path)
+			return err
+		}); err != nil {
+			return fmt.Errorf("error listing image tags: %v", err)
+		}
+	}
+
+	tags, err := opt.FilterTags(srcTags, func(tag string) (time.Time, error) {
+		return imageCreated(src, tag)
+	})
+	if err != nil {
+		return err
+	}
+
+	targetTagsPresent := make([][]string, len(dests))
+	if opt.SkipExistingTags {
+		for ix, dest := range dests {
+			if err = opt.Retry.Do(ctx, opt.Log, "listing target tags",
+				func() error {
+					var err error
+					targetTagsPresent[ix], err = dest.client.listTags(dest.path)
+					if isNotFound(err) {
+						return nil
+					}
+					return err
+				}); err != nil {
+				return fmt.Errorf("error listing image tags: %v", err)
+			}
+		}
+	}
+
+	errs, interrupted := opt.SyncTags(ctx, tags, func(tag string,
+		lg *log.Logger) bool {
+
+		// the manifest is resolved once, and then written to all targets;
+		// once it's in a target, further targets are copied from there
+		var m *manifest
+		from := src
+		errs := false
+
+		for ix, dest := range dests {
+
+			if opt.SkipExistingTags {
+				tagAlreadyExists := false
+				for _, targetTag := range targetTagsPresent[ix] {
+					if tag == targetTag {
+						tagAlreadyExists = true
+						break
+					}
+				}
+
+				if tagAlreadyExists {
+					lg.With(log.Fields{"target": opt.Targets[ix].Ref}).Info(
+						"skipping tag: already present in destination")
+					opt.TagDone(tag, opt.Targets[ix], relays.TagExists, nil,
+						nil)
+					continue
+				}
+			}
+
+			if m == nil {
+				if err := opt.Retry.Do(ctx, lg, "resolving tag", func() error {
+					var err error
+					m, err = resolveManifest(lg, src, tag, opt.AllPlatforms(),
+						platforms, opt.Verbose)
+					return err
+				}); err != nil {
+					lg.Error(err)
+					for _, trgt := range opt.Targets[ix:] {
+						opt.TagDone(tag, trgt, relays.TagFailed, nil, err)
+					}
+					return true
+				}
+			}
+
+			if opt.SkipUnchangedTags && !relays.TagChanged(lg, tag,
+				func(tag string) (string, error) {
+					return m.digest, nil
+				},
+				func(tag string) (string, error) {
+					return dest.client.manifestDigest(dest.path, tag)
+				}) {
+				opt.TagDone(tag, opt.Targets[ix], relays.TagUnchanged, nil, nil)
+				if from == src {
+					from = dest
+				}
+				continue
+			}
+
+			trgt := opt.Targets[ix]
+			if opt.Planned(lg, tag, trgt) {
+				continue
+			}
+			opt.LogSyncing(lg, trgt)
+			start := time.Now()
+			// only the last attempt counts, so that retries don't inflate
+			// the bytes transferred
+			var n int64
+			err := opt.Retry.Do(ctx, lg, "syncing tag", func() error {
+				var err error
+				n, err = copyImage(lg, from, dest, tag, m, opt.Verbose)
+				return err
+			})
+			stats := &relays.TagStats{Duration: time.Since(start), Bytes: n}
+			opt.TagDone(tag, trgt, relays.CopyResult(err), stats, err)
+			if lg.With(log.Fields{"target": trgt.Ref}).Error(err) {
+				errs = true
+				continue
+			}
+			opt.LogSynced(lg, trgt, stats.Duration)
+			if from == src {
+				from = dest
+			}
+		}
+
+		return errs
+	})
+
+	// pruning after an incomplete sync could delete more than intended
+	if interrupted != nil {
+		return interrupted
+	}
+
+	if opt.Prune {
+		for ix, dest := range dests {
+			errs = opt.Log.Error(opt.PruneTarget(ctx, opt.Targets[ix], tags,
+				&pruner{repo: dest})) || errs
+		}
+	}
+
+	if errs {
+		return fmt.Errorf("errors during sync")
+	}
+
+	return nil
+}
+
+// pruner deletes tags from a target repo; the context passed to its methods
+// is ignored, since the repo's client is already bound to one
+type pruner struct {
+	repo *repo
+}
+
+//
+func (p *pruner) ListTags(_ context.Context) ([]string, error) {
+	ret, err := p.repo.client.listTags(p.repo.path)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return ret, err
+}
+
+//
+func (p *pruner) Digest(_ context.Context, tag string) (string, error) {
+	return p.repo.client.manifestDigest(p.repo.path, tag)
+}
+
+//
+func (p *pruner) Delete(_ context.Context, tag, digest string) error {
+	return p.repo.client.deleteManifest(p.repo.path, digest)
+}
+
+//
+type repo struct {
+	client *client
+	path   string
+}
+
+//
+func (r *RegistryRelay) newRepo(ctx context.Context, ref, auth string,
+	skipTLSVerify bool) (*repo, error) {
+
+	host, path, _ := docker.SplitRef(ref)
+	if host == "" || host == dockerHubHost {
+		if !strings.Contains(path, "/") {
+			path = "library/" + path
+		}
+	}
+
+	c, err := newClient(ctx, host, auth, skipTLSVerify, r.certsDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.ping(); err != nil {
+		return nil, err
+	}
+
+	return &repo{client: c, path: path}, nil
+}
+
+// imageCreated returns the creation time recorded in the config blob of the
+// image with tag; for a manifest list, the image for the platform dregsy is
+// running on is used, or the first one if there is none for it
+func imageCreated(src *repo, tag string) (time.Time, error) {
+
+	m, err := src.client.getManifest(src.path, tag)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if m.isIndex() {
+		if len(m.Manifests) == 0 {
+			return time.Time{}, fmt.Errorf("empty manifest list")
+		}
+		d, err := m.platformManifest()
+		if err != nil {
+			d = &m.Manifests[0]
+		}
+		if m, err = src.client.getManifest(src.path, d.Digest); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	if m.Config == nil {
+		return time.Time{}, fmt.Errorf("manifest has no config")
+	}
+
+	rc, err := src.client.getBlob(src.path, m.Config.Digest)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rc.Close()
+
+	var conf struct {
+		Created time.Time `json:"created"`
+	}
+	if err := json.NewDecoder(rc).Decode(&conf); err != nil {
+		return time.Time{}, fmt.Errorf("error decoding image config: %v", err)
+	}
+	return conf.Created, nil
+}
+
+// resolveManifest returns the manifest to write to the target for tag. A
+// manifest list is kept completely if allPlatforms is set, filtered down to
+// platforms if any are given, and otherwise resolved to the manifest for the
+// platform dregsy is running on.
+func resolveManifest(lg *log.Logger, src *repo, tag string, allPlatforms bool,
+	platforms []*relays.Platform, verbose bool) (*manifest, error) {
+
+	m, err := src.client.getManifest(src.path, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if !m.isIndex() || allPlatforms {
+		return m, nil
+	}
+
+	if len(platforms) > 0 {
+		return m.filterIndex(platforms)
+	}
+
+	d, err := m.platformManifest()
+	if err != nil {
+		return nil, err
+	}
+	if verbose {
+		lg.Info("resolved manifest list to %s manifest %s",
+			d.Platform, d.Digest)
+	}
+	return src.client.getManifest(src.path, d.Digest)
+}
+
+// copyImage writes the resolved manifest m for tag to dest, after copying
+// all blobs and manifests it references from src; it returns the number of
+// blob bytes transferred
+func copyImage(lg *log.Logger, src, dest *repo, tag string, m *manifest,
+	verbose bool) (int64, error) {
+
+	var n int64
+
+	if m.isIndex() {
+		for _, d := range m.Manifests {
+			if verbose {
+				lg.Info("copying %s manifest %s", d.Platform, d.Digest)
+			}
+			copied, err := copyManifest(lg, src, dest, d.Digest, verbose)
+			n += copied
+			if err != nil {
+				return n, err
+			}
+		}
+	} else {
+		copied, err := copyBlobs(lg, src, dest, m, verbose)
+		n += copied
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if verbose {
+		lg.Info("writing manifest %s", m.digest)
+	}
+	return n, dest.client.putManifest(dest.path, tag, m)
+}
+
+// copyManifest copies an image manifest referenced by a manifest list
+func copyManifest(lg *log.Logger, src, dest *repo, digest string,
+	verbose bool) (int64, error) {
+
+	m, err := src.client.getManifest(src.path, digest)
+	if err != nil {
+		return 0, err
+	}
+	if m.isIndex() {
+		return 0, fmt.Errorf("nested manifest list %s not supported", digest)
+	}
+
+	n, err := copyBlobs(lg, src, dest, m, verbose)
+	if err != nil {
+		return n, err
+	}
+	return n, dest.client.putManifest(dest.path, digest, m)
+}
+
+//
+func copyBlobs(lg *log.Logger, src, dest *repo, m *manifest,
+	verbose bool) (int64, error) {
+	var n int64
+	for _, b := range m.blobs() {
+		copied, err := copyBlob(lg, src, dest, &b, verbose)
+		n += copied
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// copyBlob copies blob b from src to dest, unless it's already there, and
+// returns the number of bytes transferred; mounting a blob from another
+// repository in the same registry does not transfer any bytes
+func copyBlob(lg *log.Logger, src, dest *repo, b *descriptor,
+	verbose bool) (int64, error) {
+
+	if b.isForeign() {
+		if verbose {
+			lg.Info("skipping foreign blob %s", b.Digest)
+		}
+		return 0, nil
+	}
+
+	exists, err := dest.client.blobExists(dest.path, b.Digest)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		if verbose {
+			lg.Info("blob %s already exists", b.Digest)
+		}
+		return 0, nil
+	}
+
+	if src.client.sameRegistry(dest.client) {
+		mounted, location, err := dest.client.mountBlob(
+			dest.path, b.Digest, src.path)
+		if err != nil {
+			return 0, err
+		}
+		if mounted {
+			if verbose {
+				lg.Info("mounted blob %s", b.Digest)
+			}
+			return 0, nil
+		}
+		return transferBlob(lg, src, b, func(rd io.Reader) error {
+			return dest.client.finishUpload(dest.path, location, b, rd)
+		}, verbose)
+	}
+
+	return transferBlob(lg, src, b, func(rd io.Reader) error {
+		return dest.client.uploadBlob(dest.path, b, rd)
+	}, verbose)
+}
+
+//
+func transferBlob(lg *log.Logger, src *repo, b *descriptor, upload func(io.Reader) error,
+	verbose bool) (int64, error) {
+
+	if verbose {
+		lg.Info("copying blob %s (%d bytes)", b.Digest, b.Size)
+	}
+
+	rc, err := src.client.getBlob(src.path, b.Digest)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	if err := upload(rc); err != nil {
+		return 0, err
+	}
+	return b.Size, nil
+}
@@ -0,0 +1,964 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yannh/dregsy/internal/pkg/relays"
+)
+
+/* ----------------------------------------------------------------------------
+ * in-memory registry implementing the parts of the distribution API the relay
+ * uses
+ */
+
+type fakeManifest struct {
+	mediaType string
+	data      []byte
+}
+
+type fakeRegistry struct {
+	mutex     sync.Mutex
+	server    *httptest.Server
+	token     string
+	manifests map[string]map[string]*fakeManifest
+	blobs     map[string]map[string][]byte
+	uploads   int
+	mounts    int
+	pushes    int
+	downloads int
+	images    int
+	// when set, the catalog is denied, and repositories need to be listed
+	// via the Harbor API
+	harbor bool
+	// number of manifest uploads to fail with 503 before accepting them
+	unavailable int
+}
+
+func newFakeRegistry(t *testing.T, token string) *fakeRegistry {
+	r := &fakeRegistry{
+		token:     token,
+		manifests: make(map[string]map[string]*fakeManifest),
+		blobs:     make(map[string]map[string][]byte),
+	}
+	r.server = httptest.NewServer(r)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *fakeRegistry) addBlob(repo string, data []byte) descriptor {
+	d := digestOf(data)
+	if r.blobs[repo] == nil {
+		r.blobs[repo] = make(map[string][]byte)
+	}
+	r.blobs[repo][d] = data
+	return descriptor{
+		MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+		Digest:    d,
+		Size:      int64(len(data)),
+	}
+}
+
+func (r *fakeRegistry) addManifest(repo, tag, mediaType string,
+	m interface{}) string {
+	data, _ := json.Marshal(m)
+	d := digestOf(data)
+	if r.manifests[repo] == nil {
+		r.manifests[repo] = make(map[string]*fakeManifest)
+	}
+	fm := &fakeManifest{mediaType: mediaType, data: data}
+	r.manifests[repo][d] = fm
+	if tag != "" {
+		r.manifests[repo][tag] = fm
+	}
+	return d
+}
+
+// addImage adds an image with a config and one layer blob; each image added
+// is created an hour after the previous one
+func (r *fakeRegistry) addImage(repo, tag, content string) string {
+	r.images++
+	created := time.Date(2020, 1, 1, r.images, 0, 0, 0, time.UTC)
+	conf := r.addBlob(repo, []byte(
+		`{"created":"`+created.Format(time.RFC3339)+`"}`))
+	conf.MediaType = "application/vnd.docker.container.image.v1+json"
+	layer := r.addBlob(repo, []byte(content))
+	return r.addManifest(repo, tag, mediaTypeDockerManifest, &manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config:        &conf,
+		Layers:        []descriptor{layer},
+	})
+}
+
+func (r *fakeRegistry) hasManifest(repo, ref string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.manifests[repo][ref]
+	return ok
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if req.URL.Path == "/token" {
+		json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+
+	// the Harbor API uses basic auth, which isn't checked here
+	if strings.HasPrefix(req.URL.Path, "/api/v2.0/") {
+		r.serveHarbor(w, req)
+		return
+	}
+
+	if r.token != "" &&
+		req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+			`Bearer realm="%s/token",service="fake"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+
+	switch {
+
+	case path == "":
+		w.WriteHeader(http.StatusOK)
+
+	case path == "_catalog":
+		r.serveCatalog(w, req)
+
+	case strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		if r.manifests[repo] == nil {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN")
+			return
+		}
+		var tags []string
+		for ref := range r.manifests[repo] {
+			if !strings.HasPrefix(ref, "sha256:") {
+				tags = append(tags, ref)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"name": repo, "tags": tags})
+
+	case strings.Contains(path, "/manifests/"):
+		ix := strings.Index(path, "/manifests/")
+		r.serveManifest(w, req, path[:ix], path[ix+len("/manifests/"):])
+
+	case strings.Contains(path, "/blobs/uploads/"):
+		ix := strings.Index(path, "/blobs/uploads/")
+		r.serveUpload(w, req, path[:ix], path[ix+len("/blobs/uploads/"):])
+
+	case strings.Contains(path, "/blobs/"):
+		ix := strings.Index(path, "/blobs/")
+		data, ok := r.blobs[path[:ix]][path[ix+len("/blobs/"):]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+		if req.Method == http.MethodGet {
+			r.downloads++
+			w.Write(data)
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveCatalog pages through repositories at most two at a time
+func (r *fakeRegistry) serveCatalog(w http.ResponseWriter, req *http.Request) {
+
+	if r.harbor {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED")
+		return
+	}
+
+	var repos []string
+	for repo := range r.manifests {
+		if repo > req.URL.Query().Get("last") {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+
+	n := 2
+	if q, _ := strconv.Atoi(req.URL.Query().Get("n")); q > 0 && q < n {
+		n = q
+	}
+	if len(repos) > n {
+		repos = repos[:n]
+		w.Header().Set("Link", fmt.Sprintf(
+			`</v2/_catalog?n=%d&last=%s>; rel="next"`, n, repos[n-1]))
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"repositories": repos})
+}
+
+// serveHarbor serves projects and their repositories, without pagination
+func (r *fakeRegistry) serveHarbor(w http.ResponseWriter, req *http.Request) {
+
+	if !r.harbor {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/api/v2.0/projects")
+	type item struct {
+		Name string `json:"name"`
+	}
+	items := []item{}
+
+	for repo := range r.manifests {
+		project := strings.SplitN(repo, "/", 2)[0]
+		switch path {
+		case "":
+			found := false
+			for _, i := range items {
+				found = found || i.Name == project
+			}
+			if !found {
+				items = append(items, item{Name: project})
+			}
+		case "/" + project + "/repositories":
+			items = append(items, item{Name: repo})
+		}
+	}
+
+	json.NewEncoder(w).Encode(items)
+}
+
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request,
+	repo, ref string) {
+
+	switch req.Method {
+
+	case http.MethodGet, http.MethodHead:
+		m, ok := r.manifests[repo][ref]
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digestOf(m.data))
+		if req.Method == http.MethodGet {
+			w.Write(m.data)
+		}
+
+	case http.MethodPut:
+		if r.unavailable > 0 {
+			r.unavailable--
+			writeError(w, http.StatusServiceUnavailable, "UNAVAILABLE")
+			return
+		}
+		data, _ := ioutil.ReadAll(req.Body)
+		var mf manifest
+		json.Unmarshal(data, &mf)
+		for _, b := range mf.blobs() {
+			if _, ok := r.blobs[repo][b.Digest]; !ok {
+				writeError(w, http.StatusBadRequest, "BLOB_UNKNOWN")
+				return
+			}
+		}
+		for _, c := range mf.Manifests {
+			if _, ok := r.manifests[repo][c.Digest]; !ok {
+				writeError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN")
+				return
+			}
+		}
+		if r.manifests[repo] == nil {
+			r.manifests[repo] = make(map[string]*fakeManifest)
+		}
+		fm := &fakeManifest{
+			mediaType: req.Header.Get("Content-Type"), data: data}
+		r.manifests[repo][ref] = fm
+		r.manifests[repo][digestOf(data)] = fm
+		r.pushes++
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodDelete:
+		m, ok := r.manifests[repo][ref]
+		if !ok || !strings.HasPrefix(ref, "sha256:") {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		for k, v := range r.manifests[repo] {
+			if v == m {
+				delete(r.manifests[repo], k)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request,
+	repo, id string) {
+
+	if r.blobs[repo] == nil {
+		r.blobs[repo] = make(map[string][]byte)
+	}
+
+	switch req.Method {
+
+	case http.MethodPost:
+		if mount := req.URL.Query().Get("mount"); mount != "" {
+			from := req.URL.Query().Get("from")
+			if data, ok := r.blobs[from][mount]; ok {
+				r.blobs[repo][mount] = data
+				r.mounts++
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/1", repo))
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(req.Body)
+		d := req.URL.Query().Get("digest")
+		if digestOf(data) != d {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID")
+			return
+		}
+		r.blobs[repo][d] = data
+		r.uploads++
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []errorDetail{{Code: code, Message: strings.ToLower(code)}}})
+}
+
+func digestOf(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+/* ----------------------------------------------------------------------------
+ * tests
+ */
+
+func syncOptions(srcRef, destRef string) *relays.SyncOptions {
+	return &relays.SyncOptions{
+		SrcRef:           srcRef,
+		SrcSkipTLSVerify: true,
+		Targets: []*relays.Target{
+			{Ref: destRef, SkipTLSVerify: true},
+		},
+	}
+}
+
+func TestSync(t *testing.T) {
+
+	src := newFakeRegistry(t, "secret")
+	src.addImage("test/image", "v1", "one")
+	src.addImage("test/image", "v2", "two")
+
+	dest := newFakeRegistry(t, "")
+	relay := NewRegistryRelay(nil)
+
+	srcRef := src.host() + "/test/image"
+	destRef := dest.host() + "/mirror/image"
+
+	err := relay.Sync(context.Background(), syncOptions(srcRef, destRef))
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	for _, tag := range []string{"v1", "v2"} {
+		if !dest.hasManifest("mirror/image", tag) {
+			t.Errorf("tag %s not synced", tag)
+		}
+	}
+	if dest.uploads != 4 {
+		t.Errorf("expected 4 blob uploads, got %d", dest.uploads)
+	}
+
+	src.addImage("test/image", "v3", "three")
+	opt := syncOptions(srcRef, destRef)
+	opt.ExcludeTags = []string{"v1"}
+	opt.SkipExistingTags = true
+	if err := relay.Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if !dest.hasManifest("mirror/image", "v3") {
+		t.Error("tag v3 not synced")
+	}
+	if dest.uploads != 6 {
+		t.Errorf("expected 6 blob uploads, got %d", dest.uploads)
+	}
+}
+
+// addManifestList adds a list with a manifest for the platform the test is
+// running on, and one for plan9/mips
+func (r *fakeRegistry) addManifestList(repo, tag string) (
+	list, own, other string) {
+	own = r.addImage(repo, "", "own")
+	other = r.addImage(repo, "", "other")
+	list = r.addManifest(repo, tag, mediaTypeDockerManifestList,
+		&manifest{
+			SchemaVersion: 2,
+			MediaType:     mediaTypeDockerManifestList,
+			Manifests: []descriptor{
+				{
+					MediaType: mediaTypeDockerManifest,
+					Digest:    other,
+					Platform:  &platform{OS: "plan9", Architecture: "mips"},
+				},
+				{
+					MediaType: mediaTypeDockerManifest,
+					Digest:    own,
+					Platform: &platform{
+						OS: runtime.GOOS, Architecture: runtime.GOARCH},
+				},
+			},
+		})
+	return list, own, other
+}
+
+func TestSyncManifestList(t *testing.T) {
+
+	reg := newFakeRegistry(t, "")
+	_, own, other := reg.addManifestList("test/image", "multi")
+
+	opt := syncOptions(reg.host()+"/test/image", reg.host()+"/mirror/image")
+	opt.Tags = []string{"multi"}
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if !reg.hasManifest("mirror/image", own) {
+		t.Error("manifest for own platform not synced")
+	}
+	if reg.hasManifest("mirror/image", other) {
+		t.Error("manifest for other platform should not be synced")
+	}
+	if reg.mounts != 2 || reg.uploads != 0 {
+		t.Errorf("expected 2 mounts and no uploads, got %d and %d",
+			reg.mounts, reg.uploads)
+	}
+}
+
+func TestSyncPlatforms(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	list, own, other := src.addManifestList("test/image", "multi")
+
+	dest := newFakeRegistry(t, "")
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/all/image")
+	opt.Platforms = []string{relays.PlatformAll}
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for _, ref := range []string{list, own, other} {
+		if !dest.hasManifest("all/image", ref) {
+			t.Errorf("manifest %s not synced", ref)
+		}
+	}
+
+	opt.Targets[0].Ref = dest.host() + "/filtered/image"
+	opt.Platforms = []string{"plan9/mips", "linux/s390x"}
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if !dest.hasManifest("filtered/image", other) {
+		t.Error("manifest for selected platform not synced")
+	}
+	if dest.hasManifest("filtered/image", own) ||
+		dest.hasManifest("filtered/image", list) {
+		t.Error("manifest list should have been filtered")
+	}
+
+	c, _ := newClient(context.Background(), dest.host(), "", true, "")
+	c.ping()
+	m, err := c.getManifest("filtered/image", "multi")
+	if err != nil {
+		t.Fatalf("cannot get filtered manifest list: %v", err)
+	}
+	if !m.isIndex() || len(m.Manifests) != 1 || m.Manifests[0].Digest != other {
+		t.Errorf("unexpected filtered manifest list: %s", m.raw)
+	}
+
+	opt.Platforms = []string{"linux/s390x"}
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err == nil {
+		t.Error("sync without any matching platform should fail")
+	}
+}
+
+func TestSyncLatest(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	src.addImage("test/image", "v1.10", "one")
+	src.addImage("test/image", "v1.9", "two")
+	src.addImage("test/image", "v1.2", "three")
+	src.addImage("test/image", "latest", "four")
+
+	for sortBy, expect := range map[string]string{
+		"semver":  "v1.10",
+		"lexical": "v1.9",
+		"created": "v1.2",
+	} {
+		dest := newFakeRegistry(t, "")
+		opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+		opt.ExcludeTags = []string{"latest"}
+		opt.Latest = 1
+		opt.SortBy = sortBy
+		if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+			t.Fatalf("sync failed: %v", err)
+		}
+		for _, tag := range []string{"v1.10", "v1.9", "v1.2"} {
+			if dest.hasManifest("test/image", tag) != (tag == expect) {
+				t.Errorf("sort by %s: expected only %s to be synced",
+					sortBy, expect)
+			}
+		}
+	}
+}
+
+func TestSyncAge(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	src.addImage("test/image", "old", "one")
+	src.addImage("test/image", "mid", "two")
+	src.addImage("test/image", "new", "three")
+	dest := newFakeRegistry(t, "")
+
+	// ages are relative to now, so put the bounds half an hour around the
+	// creation time of 'mid'
+	mid := time.Since(time.Date(2020, 1, 1, 2, 0, 0, 0, time.UTC))
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+	opt.MinAge = mid - 30*time.Minute
+	opt.MaxAge = mid + 30*time.Minute
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	for tag, expect := range map[string]bool{
+		"old": false, "mid": true, "new": false} {
+		if dest.hasManifest("test/image", tag) != expect {
+			t.Errorf("tag %s: expected synced to be %v", tag, expect)
+		}
+	}
+}
+
+func TestSyncUnchanged(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	src.addImage("test/image", "v1", "one")
+	src.addImage("test/image", "latest", "two")
+	src.addManifestList("test/image", "multi")
+	dest := newFakeRegistry(t, "")
+
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+	opt.SkipUnchangedTags = true
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if dest.pushes != 3 {
+		t.Errorf("expected 3 manifest pushes, got %d", dest.pushes)
+	}
+
+	// nothing changed, so nothing gets pushed, even though the manifest list
+	// was resolved to a single image
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if dest.pushes != 3 {
+		t.Errorf("expected no further manifest pushes, got %d",
+			dest.pushes-3)
+	}
+
+	// move latest
+	moved := src.addImage("test/image", "latest", "three")
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if dest.pushes != 4 {
+		t.Errorf("expected 1 further manifest push, got %d", dest.pushes-3)
+	}
+	if !dest.hasManifest("test/image", moved) {
+		t.Error("moved tag latest not updated")
+	}
+}
+
+func TestSyncPrune(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	src.addImage("test/image", "v1", "one")
+	src.addImage("test/image", "v2", "two")
+	src.addImage("test/image", "v3", "three")
+
+	dest := newFakeRegistry(t, "")
+	v1 := dest.addImage("test/image", "v1", "one")
+	dest.manifests["test/image"]["alias"] = dest.manifests["test/image"][v1]
+	dest.addImage("test/image", "v0", "zero")
+	dest.addImage("test/image", "stable", "stable")
+
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+	opt.ExcludeTags = []string{"v3"}
+	opt.Prune = true
+	opt.PruneProtect = []string{"stable"}
+	opt.PruneDryRun = true
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if !dest.hasManifest("test/image", "v0") {
+		t.Error("tag v0 pruned in dry run")
+	}
+
+	opt.PruneDryRun = false
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for tag, expect := range map[string]bool{
+		"v0": false, "v1": true, "v2": true, "v3": false,
+		// protected by pattern, and by sharing its manifest with v1
+		"stable": true, "alias": true} {
+		if dest.hasManifest("test/image", tag) != expect {
+			t.Errorf("tag %s: expected present to be %v", tag, expect)
+		}
+	}
+}
+
+func TestSyncTargets(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	src.addImage("test/image", "v1", "one")
+	src.addManifestList("test/image", "multi")
+	dest1 := newFakeRegistry(t, "")
+	dest2 := newFakeRegistry(t, "token")
+
+	opt := syncOptions(src.host()+"/test/image", dest1.host()+"/test/image")
+	opt.Platforms = []string{relays.PlatformAll}
+	opt.Targets = append(opt.Targets, &relays.Target{
+		Ref: dest2.host() + "/mirror/image", SkipTLSVerify: true})
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	for _, tag := range []string{"v1", "multi"} {
+		if !dest1.hasManifest("test/image", tag) {
+			t.Errorf("tag %s not synced to first target", tag)
+		}
+		if !dest2.hasManifest("mirror/image", tag) {
+			t.Errorf("tag %s not synced to second target", tag)
+		}
+	}
+
+	// one config and one layer blob per image, each downloaded just once
+	// from the source
+	if src.downloads != 6 {
+		t.Errorf("expected 6 blob downloads from source, got %d",
+			src.downloads)
+	}
+	if dest1.downloads != 6 {
+		t.Errorf("expected 6 blob downloads from first target, got %d",
+			dest1.downloads)
+	}
+}
+
+// countingLimiter lets a fixed number of tags sync concurrently, and records
+// the highest number of concurrent syncs seen
+type countingLimiter struct {
+	slots  chan struct{}
+	mutex  sync.Mutex
+	active int
+	max    int
+}
+
+func (l *countingLimiter) Acquire() func() {
+	l.slots <- struct{}{}
+	l.mutex.Lock()
+	l.active++
+	if l.active > l.max {
+		l.max = l.active
+	}
+	l.mutex.Unlock()
+	return func() {
+		l.mutex.Lock()
+		l.active--
+		l.mutex.Unlock()
+		<-l.slots
+	}
+}
+
+func TestSyncConcurrent(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	var tags []string
+	for i := 0; i < 8; i++ {
+		tag := fmt.Sprintf("v%d", i)
+		src.addImage("test/image", tag, tag)
+		tags = append(tags, tag)
+	}
+	dest := newFakeRegistry(t, "")
+
+	limiter := &countingLimiter{slots: make(chan struct{}, 3)}
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+	opt.Tags = append(tags, "missing")
+	opt.Limiter = limiter
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err == nil {
+		t.Error("sync of missing tag should fail")
+	}
+
+	for _, tag := range tags {
+		if !dest.hasManifest("test/image", tag) {
+			t.Errorf("tag %s not synced", tag)
+		}
+	}
+	if limiter.max > 3 {
+		t.Errorf("expected at most 3 concurrent syncs, got %d", limiter.max)
+	}
+	if limiter.active != 0 {
+		t.Errorf("%d slots not released", limiter.active)
+	}
+}
+
+func TestSyncRetry(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	src.addImage("test/image", "v1", "one")
+	dest := newFakeRegistry(t, "")
+	dest.unavailable = 2
+
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+	opt.Retry = &relays.RetryPolicy{Attempts: 1, Delay: time.Millisecond}
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err == nil {
+		t.Error("sync should fail with too few retries")
+	}
+
+	dest.unavailable = 2
+	opt.Retry.Attempts = 3
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if !dest.hasManifest("test/image", "v1") {
+		t.Error("tag not synced after retries")
+	}
+}
+
+// recordingObserver records the selected tags, and the results and bytes
+// reported for each tag
+type recordingObserver struct {
+	mutex    sync.Mutex
+	selected []string
+	results  map[string]relays.TagResult
+	bytes    map[string]int64
+}
+
+func (o *recordingObserver) TagsFiltered(listed, selected []string) {
+	o.selected = selected
+}
+
+func (o *recordingObserver) TagDone(tag string, trgt *relays.Target,
+	res relays.TagResult, stats *relays.TagStats, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.results[tag] = res
+	if stats != nil {
+		o.bytes[tag] = stats.Bytes
+	}
+}
+
+func TestSyncObserver(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	src.addImage("test/image", "v1", "one")
+	src.addImage("test/image", "v2", "two")
+	dest := newFakeRegistry(t, "")
+	dest.addImage("test/image", "v1", "one")
+
+	obs := &recordingObserver{
+		results: make(map[string]relays.TagResult),
+		bytes:   make(map[string]int64),
+	}
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+	opt.Tags = []string{"v1", "v2", "missing"}
+	opt.SkipExistingTags = true
+	opt.Observer = obs
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err == nil {
+		t.Error("sync of missing tag should fail")
+	}
+
+	expected := map[string]relays.TagResult{
+		"v1":      relays.TagExists,
+		"v2":      relays.TagCopied,
+		"missing": relays.TagFailed,
+	}
+	for tag, res := range expected {
+		if obs.results[tag] != res {
+			t.Errorf("expected tag '%s' to be %s, got %s", tag, res,
+				obs.results[tag])
+		}
+	}
+	if len(obs.selected) != 3 {
+		t.Errorf("unexpected selected tags: %v", obs.selected)
+	}
+	if obs.bytes["v2"] == 0 {
+		t.Error("no bytes reported for copied tag")
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	src.addImage("test/image", "v1", "one")
+	src.addImage("test/image", "v2", "two")
+	dest := newFakeRegistry(t, "")
+	dest.addImage("test/image", "v1", "one")
+	dest.addImage("test/image", "v0", "zero")
+
+	obs := &recordingObserver{
+		results: make(map[string]relays.TagResult),
+		bytes:   make(map[string]int64),
+	}
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+	opt.SkipExistingTags = true
+	opt.Prune = true
+	opt.DryRun = true
+	opt.Observer = obs
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	if dest.pushes != 0 || dest.hasManifest("test/image", "v2") ||
+		!dest.hasManifest("test/image", "v0") {
+		t.Error("target changed in dry run")
+	}
+
+	expected := map[string]relays.TagResult{
+		"v0": relays.TagPruned,
+		"v1": relays.TagExists,
+		"v2": relays.TagPlanned,
+	}
+	for tag, res := range expected {
+		if obs.results[tag] != res {
+			t.Errorf("expected tag '%s' to be %s, got %s", tag, res,
+				obs.results[tag])
+		}
+	}
+}
+
+func TestSyncInterrupted(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	src.addImage("test/image", "v1", "one")
+	src.addImage("test/image", "v2", "two")
+	dest := newFakeRegistry(t, "")
+	dest.addImage("test/image", "old", "old")
+
+	// once stopped, no further tags are synced, and nothing is pruned
+	stop := make(chan struct{})
+	close(stop)
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+	opt.Tags = []string{"v1", "v2"}
+	opt.Prune = true
+	opt.Stop = stop
+
+	err := NewRegistryRelay(nil).Sync(context.Background(), opt)
+	intr, ok := err.(*relays.Interrupted)
+	if !ok {
+		t.Fatalf("expected interrupted error, got %v", err)
+	}
+	if len(intr.Skipped) != 2 || len(intr.Aborted) != 0 || intr.Failed {
+		t.Errorf("unexpected interruption details: %+v", intr)
+	}
+	if dest.hasManifest("test/image", "v1") ||
+		!dest.hasManifest("test/image", "old") {
+		t.Error("target modified after stop")
+	}
+
+	// a cancelled context aborts right away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opt.Stop = nil
+	if err := NewRegistryRelay(nil).Sync(ctx, opt); err == nil {
+		t.Error("sync with cancelled context should fail")
+	}
+}
+
+func TestSyncError(t *testing.T) {
+
+	src := newFakeRegistry(t, "")
+	dest := newFakeRegistry(t, "")
+	c, _ := newClient(context.Background(), src.host(), "", true, "")
+	c.ping()
+
+	_, err := c.getManifest("test/image", "missing")
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected registry error, got %v", err)
+	}
+	if e.StatusCode != http.StatusNotFound || !e.HasCode("MANIFEST_UNKNOWN") {
+		t.Errorf("unexpected error details: %v", e)
+	}
+
+	opt := syncOptions(src.host()+"/test/image", dest.host()+"/test/image")
+	opt.Tags = []string{"missing"}
+	if err := NewRegistryRelay(nil).Sync(context.Background(), opt); err == nil {
+		t.Error("sync of missing tag should fail")
+	}
+}
+
+func TestListRepositories(t *testing.T) {
+
+	reg := newFakeRegistry(t, "secret")
+	expect := []string{"library/busybox", "library/nginx", "test/image"}
+	for _, repo := range expect {
+		reg.addImage(repo, "latest", repo)
+	}
+
+	for _, harbor := range []bool{false, true} {
+		reg.harbor = harbor
+		repos, err := ListRepositories(context.Background(), reg.host(), "", true, "")
+		if err != nil {
+			t.Fatalf("listing repositories failed: %v", err)
+		}
+		sort.Strings(repos)
+		if strings.Join(repos, ",") != strings.Join(expect, ",") {
+			t.Errorf("expected repositories %v, got %v", expect, repos)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	ch := parseChallenge(
+		`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull"`)
+	if ch.scheme != "bearer" {
+		t.Errorf("unexpected scheme: %s", ch.scheme)
+	}
+	for k, v := range map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/busybox:pull",
+	} {
+		if ch.params[k] != v {
+			t.Errorf("unexpected value for '%s': %s", k, ch.params[k])
+		}
+	}
+}
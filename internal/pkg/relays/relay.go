@@ -0,0 +1,316 @@
+/*
+ *
+ */
+
+package relays
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/tags"
+)
+
+// PlatformAll denotes copying all platforms of a multi-platform image
+const PlatformAll = "all"
+
+//
+type Relay interface {
+	Prepare() error
+	Dispose()
+	// Sync syncs the tags selected by opt; cancelling ctx aborts the sync,
+	// including any operations in progress
+	Sync(ctx context.Context, opt *SyncOptions) error
+}
+
+// Target is a repository to sync to
+type Target struct {
+	Ref           string
+	Auth          string
+	SkipTLSVerify bool
+}
+
+//
+type SyncOptions struct {
+	SrcRef           string
+	SrcAuth          string
+	SrcSkipTLSVerify bool
+	// each tag is synced to all targets; relays should copy to further
+	// targets from the first target a tag was synced to where possible, to
+	// save source bandwidth
+	Targets          []*Target
+	Tags             []string
+	ExcludeTags      []string
+	SkipExistingTags bool
+	// when set, a tag is only synced if its digest in the target differs
+	// from what it would be after syncing
+	SkipUnchangedTags bool
+	// when > 0, only the newest Latest of the matching tags are synced, as
+	// determined by SortBy
+	Latest int
+	SortBy string
+	// when > 0, tags with images created longer ago than MaxAge, or more
+	// recently than MinAge, are not synced
+	MinAge time.Duration
+	MaxAge time.Duration
+	// when set, tags in the target that are not among the synced tags and do
+	// not match any of the PruneProtect patterns are deleted, or with
+	// PruneDryRun, only logged
+	Prune        bool
+	PruneProtect []string
+	PruneDryRun  bool
+	// when set, tags are listed, filtered, and checked against the targets
+	// as usual, but nothing gets copied; tags that would be copied are
+	// reported as TagPlanned instead, and pruning is done as with PruneDryRun
+	DryRun bool
+	// when empty, a multi-platform image is resolved to the platform dregsy
+	// is running on; otherwise either just PlatformAll, or list of platforms
+	Platforms []string
+	Verbose   bool
+	// when set, tags are synced concurrently, as far as Limiter permits
+	Limiter Limiter
+	// for retrying the sync of a tag, and listing of tags
+	Retry *RetryPolicy
+	// closed when no further tags should be synced, e.g. when dregsy is
+	// shutting down; tags already in progress are completed, unless the
+	// context passed to Sync gets cancelled
+	Stop <-chan struct{}
+	// when set, gets notified about the result of syncing each tag
+	Observer Observer
+	// for logging, carrying context such as task and mapping as fields; may
+	// be nil
+	Log *log.Logger
+}
+
+// LogSyncing logs to lg, which is expected to carry the tag as a field, that
+// syncing to trgt is starting
+func (o *SyncOptions) LogSyncing(lg *log.Logger, trgt *Target) {
+	lg.Println()
+	lg.With(log.Fields{"target": trgt.Ref}).Info("syncing tag")
+}
+
+// Planned returns true if this is a dry run, after logging to lg and
+// reporting that tag would be synced to trgt; relays call this right before
+// copying a tag, and skip the copy if it returns true
+func (o *SyncOptions) Planned(lg *log.Logger, tag string, trgt *Target) bool {
+	if !o.DryRun {
+		return false
+	}
+	lg.With(log.Fields{"target": trgt.Ref}).Info("would sync tag (dry run)")
+	o.TagDone(tag, trgt, TagPlanned, nil, nil)
+	return true
+}
+
+// LogSynced logs to lg that syncing to trgt is done, and how long it took
+func (o *SyncOptions) LogSynced(lg *log.Logger, trgt *Target,
+	d time.Duration) {
+	lg.With(log.Fields{"target": trgt.Ref, "duration": d.Round(
+		time.Millisecond)}).Info("synced tag")
+}
+
+// ListAllTags returns true if the tags to sync can only be determined by
+// listing all tags of the source image, i.e. when no tags are given, or some
+// of them are patterns
+func (o *SyncOptions) ListAllTags() bool {
+	if len(o.Tags) == 0 {
+		return true
+	}
+	for _, tag := range o.Tags {
+		if tags.IsPattern(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterTags returns those of srcTags that should be synced, i.e. that match
+// the tag filters, limited to the newest Latest ones if set. created is only
+// used when sorting by creation time.
+func (o *SyncOptions) FilterTags(srcTags []string, created tags.CreatedFunc) (
+	[]string, error) {
+
+	ret, err := o.filterTags(srcTags, created)
+	if err == nil && o.Observer != nil {
+		o.Observer.TagsFiltered(srcTags, ret)
+	}
+	return ret, err
+}
+
+//
+func (o *SyncOptions) filterTags(srcTags []string, created tags.CreatedFunc) (
+	[]string, error) {
+
+	patterns := o.Tags
+	if len(patterns) == 0 {
+		patterns = srcTags
+	}
+
+	var ret []string
+	var err error
+	for _, tag := range srcTags {
+		match, err := tags.Match(tag, patterns, o.ExcludeTags)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			ret = append(ret, tag)
+		}
+	}
+
+	if o.MinAge > 0 || o.MaxAge > 0 {
+		created = cacheCreated(created)
+		if ret, err = o.filterAge(ret, created); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.Latest > 0 {
+		return tags.Latest(ret, o.Latest, o.SortBy, created)
+	}
+	return ret, nil
+}
+
+//
+func (o *SyncOptions) filterAge(candidates []string,
+	created tags.CreatedFunc) ([]string, error) {
+
+	var ret []string
+	now := time.Now()
+
+	for _, tag := range candidates {
+		c, err := created(tag)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"cannot determine creation time of tag '%s': %v", tag, err)
+		}
+		age := now.Sub(c).Round(time.Second)
+		lg := o.Log.With(log.Fields{"tag": tag})
+		if o.MaxAge > 0 && age > o.MaxAge {
+			lg.Info("skipping tag: created %s ago, older than %s",
+				age, o.MaxAge)
+			continue
+		}
+		if o.MinAge > 0 && age < o.MinAge {
+			lg.Info("skipping tag: created %s ago, newer than %s",
+				age, o.MinAge)
+			continue
+		}
+		ret = append(ret, tag)
+	}
+
+	return ret, nil
+}
+
+// cacheCreated wraps created so that each tag is only looked up once
+func cacheCreated(created tags.CreatedFunc) tags.CreatedFunc {
+	cache := make(map[string]time.Time)
+	return func(tag string) (time.Time, error) {
+		if c, ok := cache[tag]; ok {
+			return c, nil
+		}
+		c, err := created(tag)
+		if err == nil {
+			cache[tag] = c
+		}
+		return c, err
+	}
+}
+
+// DigestFunc returns the manifest digest for tag, or an empty string if it
+// cannot be found
+type DigestFunc func(tag string) (string, error)
+
+// TagChanged compares the digest tag is expected to have in the target after
+// syncing, as returned by want, with the digest it actually has there, as
+// returned by have, and logs to lg, which is expected to carry the tag as a
+// field, whether the tag is new, updated, or unchanged. It returns true unless
+// the tag is unchanged. If either digest cannot be determined, the tag is
+// considered changed, so that it gets synced.
+func TagChanged(lg *log.Logger, tag string, want, have DigestFunc) bool {
+
+	current, err := have(tag)
+	if err != nil {
+		lg.With(log.Fields{"error": err}).Warning(
+			"cannot determine digest of tag in target")
+		return true
+	}
+	if current == "" {
+		lg.Info("tag is new")
+		return true
+	}
+
+	expected, err := want(tag)
+	if err != nil {
+		lg.With(log.Fields{"error": err}).Warning(
+			"cannot determine digest of tag in source")
+		return true
+	}
+	if expected != current {
+		lg.Info("tag updated: %s in target, %s in source",
+			current, expectedOrUnknown(expected))
+		return true
+	}
+
+	lg.Info("skipping tag: unchanged, digest %s", current)
+	return false
+}
+
+//
+func expectedOrUnknown(digest string) string {
+	if digest == "" {
+		return "unknown"
+	}
+	return digest
+}
+
+// AllPlatforms returns true if all platforms of a multi-platform image
+// should be copied
+func (o *SyncOptions) AllPlatforms() bool {
+	return len(o.Platforms) == 1 && o.Platforms[0] == PlatformAll
+}
+
+//
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// ParsePlatform parses a platform specification in the form of
+// os/architecture[/variant], e.g. linux/arm64 or linux/arm/v7
+func ParsePlatform(p string) (*Platform, error) {
+	parts := strings.Split(p, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf(
+			"invalid platform '%s', must be os/architecture[/variant]", p)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf(
+				"invalid platform '%s', must be os/architecture[/variant]", p)
+		}
+	}
+	ret := &Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		ret.Variant = parts[2]
+	}
+	return ret, nil
+}
+
+// Matches checks whether the given platform properties match this platform. A
+// platform without variant matches all variants.
+func (p *Platform) Matches(os, arch, variant string) bool {
+	return p.OS == os && p.Architecture == arch &&
+		(p.Variant == "" || p.Variant == variant)
+}
+
+//
+func (p *Platform) String() string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+}
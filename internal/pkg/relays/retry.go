@@ -0,0 +1,113 @@
+/*
+ *
+ */
+
+package relays
+
+import (
+	"context"
+	"errors"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/yannh/dregsy/internal/pkg/log"
+)
+
+// RetryPolicy determines how failed operations are retried; a nil policy
+// means no retries
+type RetryPolicy struct {
+	// number of retries after the first attempt
+	Attempts int
+	// delay before the first retry, doubled for each further retry up to
+	// MaxDelay
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// Retryable can be implemented by errors that know whether the failed
+// operation may succeed when retried
+type Retryable interface {
+	Retryable() bool
+}
+
+// messages indicating transient problems, as found in errors from registries,
+// the Docker daemon, or skopeo; status codes only count when given as such,
+// since messages also contain image refs and tags, e.g. 'app-503:1.502'
+var transientErrors = regexp.MustCompile(`(?i)` +
+	`\bstatus(?: code)?:? *(408|429|500|502|503|504)\b|request timeout|` +
+	`too ?many ?requests|bad gateway|service unavailable|gateway timeout|` +
+	`internal server error|connection reset|connection refused|` +
+	`broken pipe|i/o timeout|tls handshake timeout|unexpected eof|` +
+	`temporary failure`)
+
+// IsRetryable returns true if err indicates a problem that may go away when
+// retrying, such as a timeout, a dropped connection, or a registry that is
+// temporarily unavailable
+func IsRetryable(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	var r Retryable
+	if errors.As(err, &r) {
+		return r.Retryable()
+	}
+
+	// any *url.Error is a net.Error, including permanent failures such as
+	// unknown hosts or certificate errors, so only timeouts count here
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	return transientErrors.MatchString(err.Error())
+}
+
+// IsRetryableStatus returns true for HTTP status codes that indicate a
+// transient problem
+func IsRetryableStatus(status int) bool {
+	switch status {
+	case 408, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// Do calls op until it succeeds, fails with an error that is not retryable,
+// the retries are exhausted, or ctx is cancelled, and returns the last error.
+// Retries are logged to lg, mentioning what is being done.
+func (p *RetryPolicy) Do(ctx context.Context, lg *log.Logger, what string,
+	op func() error) error {
+
+	err := op()
+	if p == nil {
+		return err
+	}
+
+	delay := p.Delay
+	for attempt := 1; err != nil && attempt <= p.Attempts; attempt++ {
+
+		if !IsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		lg.With(log.Fields{"error": err}).Warning(
+			"%s failed, retry %d of %d in %s",
+			what, attempt, p.Attempts, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		err = op()
+
+		if delay *= 2; p.MaxDelay > 0 && delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,100 @@
+package relays
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("status %d", int(e))
+}
+
+func (e statusError) Retryable() bool {
+	return e >= 500
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, testCase := range []struct {
+		err    error
+		expect bool
+	}{
+		{nil, false},
+		{errors.New("manifest unknown"), false},
+		{errors.New("unauthorized: authentication required"), false},
+		{errors.New("received unexpected HTTP status: 502 Bad Gateway"), true},
+		{errors.New("toomanyrequests: rate limit exceeded"), true},
+		{errors.New("received unexpected HTTP status: 503"), true},
+		{errors.New("unexpected status code 429"), true},
+		// status codes in image refs and tags are not taken as such
+		{errors.New("reading manifest 1.502 in registry.acme.com/app-503: " +
+			"manifest unknown"), false},
+		{errors.New("read tcp 10.0.0.1:443: connection reset by peer"), true},
+		{errors.New("net/http: TLS handshake timeout"), true},
+		{statusError(503), true},
+		{statusError(404), false},
+		// an error that knows better is not second guessed
+		{fmt.Errorf("error: %w", statusError(429)), false},
+		{&net.DNSError{Err: "i/o timeout", IsTimeout: true}, true},
+		{&net.OpError{Op: "dial", Net: "tcp",
+			Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		// network errors that are not transient
+		{&url.Error{Op: "Get", URL: "https://registry.acme.com/v2/",
+			Err: &net.DNSError{Err: "no such host", Name: "registry.acme.com",
+				IsNotFound: true}}, false},
+		{&url.Error{Op: "Get", URL: "https://registry.acme.com/v2/",
+			Err: errors.New("x509: certificate signed by unknown authority")},
+			false},
+	} {
+		if got := IsRetryable(testCase.err); got != testCase.expect {
+			t.Errorf("%v: expected %v, got %v", testCase.err,
+				testCase.expect, got)
+		}
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+
+	calls := 0
+	failing := func(err error, times int) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= times {
+				return err
+			}
+			return nil
+		}
+	}
+	transient := errors.New("503 Service Unavailable")
+
+	var none *RetryPolicy
+	if err := none.Do(context.Background(), nil, "test", failing(transient, 1)); err == nil ||
+		calls != 1 {
+		t.Errorf("without policy, expected a single failed call, got %d",
+			calls)
+	}
+
+	p := &RetryPolicy{Attempts: 3, Delay: time.Millisecond,
+		MaxDelay: 2 * time.Millisecond}
+	if err := p.Do(context.Background(), nil, "test", failing(transient, 3)); err != nil ||
+		calls != 4 {
+		t.Errorf("expected success after 4 calls, got %d: %v", calls, err)
+	}
+	if err := p.Do(context.Background(), nil, "test", failing(transient, 4)); err == nil ||
+		calls != 4 {
+		t.Errorf("expected failure after 4 calls, got %d", calls)
+	}
+	if err := p.Do(context.Background(), nil, "test", failing(
+		errors.New("manifest unknown"), 1)); err == nil || calls != 1 {
+		t.Errorf("permanent error should not be retried, got %d calls", calls)
+	}
+}
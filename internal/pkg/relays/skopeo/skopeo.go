@@ -2,16 +2,22 @@ package skopeo
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"runtime"
 	"strings"
+	"time"
 
 	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/relays"
 )
 
 const defaultSkopeoBinary = "skopeo"
@@ -26,6 +32,11 @@ func init() {
 	certsBaseDir = defaultCertsBaseDir
 }
 
+// CertsBaseDir returns the directory under which skopeo looks for certs
+func CertsBaseDir() string {
+	return certsBaseDir
+}
+
 //
 type creds struct {
 	Username string
@@ -39,8 +50,8 @@ type tagList struct {
 }
 
 //
-func listAllTags(ref, creds, certDir string, skipTLSVerify bool) (
-	[]string, error) {
+func listAllTags(ctx context.Context, ref, creds, certDir string,
+	skipTLSVerify bool) ([]string, error) {
 
 	cmd := []string{
 		"list-tags",
@@ -63,9 +74,9 @@ func listAllTags(ref, creds, certDir string, skipTLSVerify bool) (
 	bufOut := new(bytes.Buffer)
 	bufErr := new(bytes.Buffer)
 
-	if err := runSkopeo(bufOut, bufErr, true, cmd...); err != nil {
+	if err := runSkopeo(ctx, bufOut, bufErr, true, cmd...); err != nil {
 		return nil,
-			fmt.Errorf("error listing image tags: %s, %v", bufErr.String(), err)
+			fmt.Errorf("error listing image tags: %s, %w", bufErr.String(), err)
 	}
 
 	list, err := decodeTagList(bufOut.Bytes())
@@ -75,6 +86,152 @@ func listAllTags(ref, creds, certDir string, skipTLSVerify bool) (
 	return list.Tags, nil
 }
 
+//
+type imageInfo struct {
+	Created time.Time `json:"Created"`
+}
+
+//
+func inspectCreated(ctx context.Context, ref, creds, certDir string,
+	skipTLSVerify bool) (time.Time, error) {
+
+	out, err := inspect(ctx, ref, creds, certDir, skipTLSVerify, false)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var info imageInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return time.Time{}, err
+	}
+	return info.Created, nil
+}
+
+// errManifestUnknown is returned by inspect when the image does not exist
+var errManifestUnknown = errors.New("manifest unknown")
+
+//
+func inspect(ctx context.Context, ref, creds, certDir string, skipTLSVerify,
+	raw bool) ([]byte, error) {
+
+	cmd := []string{
+		"inspect",
+	}
+
+	if raw {
+		cmd = append(cmd, "--raw")
+	}
+
+	if skipTLSVerify {
+		cmd = append(cmd, "--tls-verify=false")
+	}
+
+	if creds != "" {
+		cmd = append(cmd, fmt.Sprintf("--creds=%s", creds))
+	}
+
+	if certDir != "" {
+		cmd = append(cmd, fmt.Sprintf("--cert-dir=%s", certDir))
+	}
+
+	cmd = append(cmd, "docker://"+ref)
+
+	bufOut := new(bytes.Buffer)
+	bufErr := new(bytes.Buffer)
+
+	if err := runSkopeo(ctx, bufOut, bufErr, true, cmd...); err != nil {
+		// skopeo does not tell us the status code, so go by the message
+		msg := strings.ToLower(bufErr.String())
+		if strings.Contains(msg, "manifest unknown") ||
+			strings.Contains(msg, "name unknown") {
+			return nil, errManifestUnknown
+		}
+		return nil,
+			fmt.Errorf("error inspecting image: %s, %v", bufErr.String(), err)
+	}
+
+	return bufOut.Bytes(), nil
+}
+
+//
+type manifestList struct {
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform *struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// manifestDigest returns the digest of the manifest skopeo copies for ref. If
+// ref is a manifest list and not all platforms are copied, this is the digest
+// of the manifest for platform, or for the platform dregsy is running on if
+// platform is nil. For a non-existing image, an empty digest is returned.
+func manifestDigest(ctx context.Context, ref, creds, certDir string,
+	skipTLSVerify, allPlatforms bool, platform *relays.Platform) (
+	string, error) {
+
+	raw, err := inspect(ctx, ref, creds, certDir, skipTLSVerify, true)
+	if err == errManifestUnknown {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var list manifestList
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return "", fmt.Errorf("error decoding manifest: %v", err)
+	}
+	if allPlatforms || len(list.Manifests) == 0 {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(raw)), nil
+	}
+
+	if platform == nil {
+		platform = &relays.Platform{
+			OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	}
+	for _, m := range list.Manifests {
+		if m.Platform != nil && platform.Matches(
+			m.Platform.OS, m.Platform.Architecture, m.Platform.Variant) {
+			return m.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no manifest for platform %s in manifest list",
+		platform)
+}
+
+//
+func deleteImage(ctx context.Context, ref, creds, certDir string,
+	skipTLSVerify bool) error {
+
+	cmd := []string{
+		"delete",
+	}
+
+	if skipTLSVerify {
+		cmd = append(cmd, "--tls-verify=false")
+	}
+
+	if creds != "" {
+		cmd = append(cmd, fmt.Sprintf("--creds=%s", creds))
+	}
+
+	if certDir != "" {
+		cmd = append(cmd, fmt.Sprintf("--cert-dir=%s", certDir))
+	}
+
+	cmd = append(cmd, "docker://"+ref)
+
+	bufErr := new(bytes.Buffer)
+	if err := runSkopeo(ctx, nil, bufErr, true, cmd...); err != nil {
+		return fmt.Errorf("error deleting image: %s, %v", bufErr.String(), err)
+	}
+	return nil
+}
+
 //
 func chooseOutStream(out io.Writer, verbose, isErrorStream bool) io.Writer {
 	if verbose {
@@ -91,20 +248,50 @@ func chooseOutStream(out io.Writer, verbose, isErrorStream bool) io.Writer {
 	return ioutil.Discard
 }
 
+// skopeoError is returned when skopeo fails, along with what it wrote to
+// stderr
+type skopeoError struct {
+	err    error
+	stderr string
+}
+
 //
-func runSkopeo(outWr, errWr io.Writer, verbose bool, args ...string) error {
+func (e *skopeoError) Error() string {
+	return e.err.Error()
+}
 
-	cmd := exec.Command(skopeoBinary, args...)
+//
+func (e *skopeoError) Unwrap() error {
+	return e.err
+}
 
+// Retryable implements relays.Retryable; skopeo exits with status 1 when an
+// operation failed, so any other status is not worth retrying
+func (e *skopeoError) Retryable() bool {
+	var exitErr *exec.ExitError
+	if !errors.As(e.err, &exitErr) || exitErr.ExitCode() != 1 {
+		return false
+	}
+	return relays.IsRetryable(errors.New(e.stderr))
+}
+
+// runSkopeo runs skopeo with args; the process is killed when ctx is cancelled
+func runSkopeo(ctx context.Context, outWr, errWr io.Writer, verbose bool,
+	args ...string) error {
+
+	cmd := exec.CommandContext(ctx, skopeoBinary, args...)
+
+	// stderr is also kept for telling whether an error is transient
+	stderr := new(bytes.Buffer)
 	cmd.Stdout = chooseOutStream(outWr, verbose, false)
-	cmd.Stderr = chooseOutStream(errWr, verbose, true)
+	cmd.Stderr = io.MultiWriter(chooseOutStream(errWr, verbose, true), stderr)
 
 	if err := cmd.Start(); err != nil {
 		return err
 	}
 
 	if err := cmd.Wait(); err != nil {
-		return err
+		return &skopeoError{err: err, stderr: stderr.String()}
 	}
 
 	return nil
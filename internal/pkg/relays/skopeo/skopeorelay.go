@@ -2,12 +2,14 @@ package skopeo
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/relays"
 	"github.com/yannh/dregsy/internal/pkg/relays/docker"
-	t "github.com/yannh/dregsy/internal/pkg/tags"
 )
 
 const RelayID = "skopeo"
@@ -46,7 +48,8 @@ func NewSkopeoRelay(conf *RelayConfig, out io.Writer) *SkopeoRelay {
 //
 func (r *SkopeoRelay) Prepare() error {
 	bufOut := new(bytes.Buffer)
-	if err := runSkopeo(bufOut, nil, true, "--version"); err != nil {
+	if err := runSkopeo(
+		context.Background(), bufOut, nil, true, "--version"); err != nil {
 		return fmt.Errorf("cannot execute skopeo: %v", err)
 	}
 	log.Println()
@@ -60,95 +63,169 @@ func (r *SkopeoRelay) Dispose() {
 }
 
 //
-func (r *SkopeoRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
-	destRef, destAuth string, destSkipTLSVerify bool,
-	tags []string, excludeTags []string, skipExistingTags bool, verbose bool) error {
+func (r *SkopeoRelay) Sync(ctx context.Context,
+	opt *relays.SyncOptions) error {
 
-	srcCreds := decodeJSONAuth(srcAuth)
-	destCreds := decodeJSONAuth(destAuth)
+	src := newLocation(opt.SrcRef, opt.SrcAuth, opt.SrcSkipTLSVerify)
+	var dests []*location
+	for _, trgt := range opt.Targets {
+		dests = append(dests,
+			newLocation(trgt.Ref, trgt.Auth, trgt.SkipTLSVerify))
+	}
 
 	cmd := []string{
 		"--insecure-policy",
-		"copy",
 	}
 
-	if srcSkipTLSVerify {
-		cmd = append(cmd, "--src-tls-verify=false")
-	}
-	if destSkipTLSVerify {
-		cmd = append(cmd, "--dest-tls-verify=false")
+	platformAll := false
+	var platform *relays.Platform
+	if opt.AllPlatforms() {
+		platformAll = true
+	} else if len(opt.Platforms) > 1 {
+		return fmt.Errorf(
+			"%s relay can only sync all or a single platform", RelayID)
+	} else if len(opt.Platforms) == 1 {
+		p, err := relays.ParsePlatform(opt.Platforms[0])
+		if err != nil {
+			return err
+		}
+		platform = p
+		cmd = append(cmd,
+			fmt.Sprintf("--override-os=%s", p.OS),
+			fmt.Sprintf("--override-arch=%s", p.Architecture))
+		if p.Variant != "" {
+			cmd = append(cmd, fmt.Sprintf("--override-variant=%s", p.Variant))
+		}
 	}
 
-	srcCertDir := ""
-	repo, _, _ := docker.SplitRef(srcRef)
-	if repo != "" {
-		srcCertDir = fmt.Sprintf("%s/%s", certsBaseDir, withoutPort(repo))
-		cmd = append(cmd, fmt.Sprintf("--src-cert-dir=%s", srcCertDir))
-	}
-	destCertDir := ""
-	repo, _, _ = docker.SplitRef(destRef)
-	if repo != "" {
-		destCertDir = fmt.Sprintf("%s/%s", certsBaseDir, withoutPort(repo))
-		cmd = append(cmd, fmt.Sprintf(
-			"--dest-cert-dir=%s/%s", certsBaseDir, withoutPort(repo)))
-	}
+	cmd = append(cmd, "copy")
 
-	if srcCreds != "" {
-		cmd = append(cmd, fmt.Sprintf("--src-creds=%s", srcCreds))
-	}
-	if destCreds != "" {
-		cmd = append(cmd, fmt.Sprintf("--dest-creds=%s", destCreds))
+	if platformAll {
+		cmd = append(cmd, "--all")
 	}
 
-	if len(tags) == 0 {
-		var err error
-		tags, err = listAllTags(srcRef, srcCreds, srcCertDir, srcSkipTLSVerify)
-		if err != nil {
+	// when tags are given as patterns, we need to match them against all
+	// tags present in the source
+	srcTags := opt.Tags
+	if opt.ListAllTags() {
+		if err := opt.Retry.Do(ctx, opt.Log, "listing image tags",
+			func() error {
+				var err error
+				srcTags, err = src.ListTags(ctx)
+				return err
+			}); err != nil {
 			return err
 		}
 	}
 
-	var targetTagsPresent []string
-	if skipExistingTags {
-		var err error
-		targetTagsPresent, err = listAllTags(destRef, destCreds, destCertDir, srcSkipTLSVerify)
-		if err != nil {
-			return err
-		}
+	tags, err := opt.FilterTags(srcTags, func(tag string) (time.Time, error) {
+		return inspectCreated(ctx, src.tagRef(tag),
+			src.creds, src.certDir, src.skipTLSVerify)
+	})
+	if err != nil {
+		return err
 	}
 
-	errs := false
-	for _, tag := range tags {
-		match, err := t.Match(tag, tags, excludeTags)
-		if err != nil {
-			return err
+	targetTagsPresent := make([][]string, len(dests))
+	if opt.SkipExistingTags {
+		for ix, dest := range dests {
+			if err = opt.Retry.Do(ctx, opt.Log, "listing target tags",
+				func() error {
+					var err error
+					targetTagsPresent[ix], err = dest.ListTags(ctx)
+					return err
+				}); err != nil {
+				return err
+			}
 		}
-		if !match {
-			continue
+	}
+
+	errs, interrupted := opt.SyncTags(ctx, tags, func(tag string,
+		lg *log.Logger) bool {
+
+		// with a buffered logger, skopeo's output goes there instead, if it
+		// would be shown at all
+		wrOut := r.wrOut
+		if lg.IsBuffered() && (wrOut != nil || log.ToTerminal) {
+			wrOut = lg
 		}
 
-		if skipExistingTags {
-			tagAlreadyExists := false
-			for _, targetTag := range targetTagsPresent {
-				if tag == targetTag {
-					tagAlreadyExists = true
-					break
+		// once a tag is in a target, further targets are copied from there
+		from := src
+		errs := false
+
+		for ix, dest := range dests {
+
+			if opt.SkipExistingTags {
+				tagAlreadyExists := false
+				for _, targetTag := range targetTagsPresent[ix] {
+					if tag == targetTag {
+						tagAlreadyExists = true
+						break
+					}
+				}
+
+				if tagAlreadyExists {
+					lg.With(log.Fields{"target": opt.Targets[ix].Ref}).Info(
+						"skipping tag: already present in destination")
+					opt.TagDone(tag, opt.Targets[ix], relays.TagExists, nil,
+						nil)
+					continue
 				}
 			}
 
-			if tagAlreadyExists {
-				log.Info("skipping tag '%s': already present in destination", tag)
+			if opt.SkipUnchangedTags && !relays.TagChanged(lg, tag,
+				func(tag string) (string, error) {
+					return manifestDigest(ctx, src.tagRef(tag), src.creds,
+						src.certDir, src.skipTLSVerify, platformAll, platform)
+				},
+				func(tag string) (string, error) {
+					return dest.Digest(ctx, tag)
+				}) {
+				opt.TagDone(tag, opt.Targets[ix], relays.TagUnchanged, nil, nil)
+				if from == src {
+					from = dest
+				}
+				continue
+			}
+
+			trgt := opt.Targets[ix]
+			if opt.Planned(lg, tag, trgt) {
+				continue
+			}
+			opt.LogSyncing(lg, trgt)
+			args := append(append(append(cmd[:len(cmd):len(cmd)],
+				from.copyArgs("src")...), dest.copyArgs("dest")...),
+				"docker://"+from.tagRef(tag), "docker://"+dest.tagRef(tag))
+			start := time.Now()
+			err := opt.Retry.Do(ctx, lg, "syncing tag", func() error {
+				return runSkopeo(ctx, wrOut, wrOut, opt.Verbose, args...)
+			})
+			stats := &relays.TagStats{Duration: time.Since(start)}
+			opt.TagDone(tag, trgt, relays.CopyResult(err), stats, err)
+			if lg.With(log.Fields{"target": trgt.Ref}).Error(err) {
+				errs = true
 				continue
 			}
+			opt.LogSynced(lg, trgt, stats.Duration)
+			if from == src {
+				from = dest
+			}
 		}
 
-		log.Println()
-		log.Info("syncing tag '%s':", tag)
-		errs = errs || log.Error(
-			runSkopeo(r.wrOut, r.wrOut, verbose,
-				append(cmd,
-					fmt.Sprintf("docker://%s:%s", srcRef, tag),
-					fmt.Sprintf("docker://%s:%s", destRef, tag))...))
+		return errs
+	})
+
+	// pruning after an incomplete sync could delete more than intended
+	if interrupted != nil {
+		return interrupted
+	}
+
+	if opt.Prune {
+		for ix, dest := range dests {
+			errs = opt.Log.Error(
+				opt.PruneTarget(ctx, opt.Targets[ix], tags, dest)) || errs
+		}
 	}
 
 	if errs {
@@ -157,3 +234,64 @@ func (r *SkopeoRelay) Sync(srcRef, srcAuth string, srcSkipTLSVerify bool,
 
 	return nil
 }
+
+// location is a source or target repository, along with what's needed for
+// accessing it with skopeo; it also implements relays.Pruner
+type location struct {
+	ref           string
+	creds         string
+	certDir       string
+	skipTLSVerify bool
+}
+
+//
+func newLocation(ref, auth string, skipTLSVerify bool) *location {
+	ret := &location{
+		ref:           ref,
+		creds:         decodeJSONAuth(auth),
+		skipTLSVerify: skipTLSVerify,
+	}
+	if repo, _, _ := docker.SplitRef(ref); repo != "" {
+		ret.certDir = fmt.Sprintf("%s/%s", certsBaseDir, withoutPort(repo))
+	}
+	return ret
+}
+
+//
+func (l *location) tagRef(tag string) string {
+	return fmt.Sprintf("%s:%s", l.ref, tag)
+}
+
+// copyArgs returns the arguments for the copy command for using this
+// location as side, i.e. 'src' or 'dest'
+func (l *location) copyArgs(side string) []string {
+	var ret []string
+	if l.skipTLSVerify {
+		ret = append(ret, fmt.Sprintf("--%s-tls-verify=false", side))
+	}
+	if l.certDir != "" {
+		ret = append(ret, fmt.Sprintf("--%s-cert-dir=%s", side, l.certDir))
+	}
+	if l.creds != "" {
+		ret = append(ret, fmt.Sprintf("--%s-creds=%s", side, l.creds))
+	}
+	return ret
+}
+
+//
+func (l *location) ListTags(ctx context.Context) ([]string, error) {
+	return listAllTags(ctx, l.ref, l.creds, l.certDir, l.skipTLSVerify)
+}
+
+//
+func (l *location) Digest(ctx context.Context, tag string) (string, error) {
+	return manifestDigest(ctx, l.tagRef(tag), l.creds, l.certDir,
+		l.skipTLSVerify, true, nil)
+}
+
+// Delete deletes by digest rather than tag, to make sure to not delete a
+// manifest the tag was moved to in the meantime
+func (l *location) Delete(ctx context.Context, tag, digest string) error {
+	return deleteImage(ctx, fmt.Sprintf("%s@%s", l.ref, digest),
+		l.creds, l.certDir, l.skipTLSVerify)
+}
@@ -5,14 +5,21 @@
 package sync
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	gosync "sync"
 	"time"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 	"io/ioutil"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -20,8 +27,11 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 
+	"github.com/yannh/dregsy/internal/pkg/cron"
 	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/relays"
 	"github.com/yannh/dregsy/internal/pkg/relays/docker"
+	"github.com/yannh/dregsy/internal/pkg/relays/registry"
 	"github.com/yannh/dregsy/internal/pkg/relays/skopeo"
 	"github.com/yannh/dregsy/internal/pkg/tags"
 )
@@ -29,136 +39,462 @@ import (
 //
 const minimumTaskInterval = 30
 const minimumAuthRefreshInterval = time.Hour
+const defaultRetryDelay = 2 * time.Second
+const defaultRetryMaxDelay = time.Minute
+const defaultGracePeriod = 30 * time.Second
+const defaultServerListen = ":8080"
 
 /* ----------------------------------------------------------------------------
  *
  */
 type syncConfig struct {
-	Skopeo     *skopeo.RelayConfig `yaml:"skopeo"`
-	APIVersion string              `yaml:"api-version"` // DEPRECATED
-	Tasks      []*task             `yaml:"tasks"`
+	Relay          string                `yaml:"relay"`
+	Docker         *docker.RelayConfig   `yaml:"docker"`
+	Skopeo         *skopeo.RelayConfig   `yaml:"skopeo"`
+	Registry       *registry.RelayConfig `yaml:"registry"`
+	APIVersion     string                `yaml:"api-version"` // DEPRECATED
+	Parallelism    int                   `yaml:"parallelism"`
+	MaxActiveTasks int                   `yaml:"max-active-tasks"`
+	Retry          *retry                `yaml:"retry"`
+	GracePeriod    *time.Duration        `yaml:"grace-period"`
+	Server         *serverConfig         `yaml:"server"`
+	Report         *reportConfig         `yaml:"report"`
+	Tasks          []*task               `yaml:"tasks"`
 }
 
-//
+// validate checks this config, and fills in defaults. Problems with the
+// global settings, and with each of the tasks, are all collected and returned
+// as configErrors, rather than stopping at the first one.
 func (c *syncConfig) validate() error {
+
+	if c.Relay == "" {
+		c.Relay = skopeo.RelayID
+	}
+
+	// the tasks inherit the relay, so checking them makes no sense without it
+	if err := validateRelay(c.Relay); err != nil {
+		return configErrors{}.add("relay", err)
+	}
+
+	var errs configErrors
+
+	if c.Parallelism < 0 {
+		errs = errs.add("parallelism", errors.New(
+			"parallelism needs to be 0 or a positive integer"))
+	}
+
+	if c.MaxActiveTasks < 0 {
+		errs = errs.add("max-active-tasks", errors.New(
+			"max-active-tasks needs to be 0 or a positive integer"))
+	}
+
+	errs = errs.add("retry", c.Retry.validate())
+
+	if c.GracePeriod == nil {
+		gp := defaultGracePeriod
+		c.GracePeriod = &gp
+	} else if *c.GracePeriod < 0 {
+		errs = errs.add("grace-period",
+			errors.New("grace-period must not be negative"))
+	}
+
+	errs = errs.add("server", c.Server.validate())
+	errs = errs.add("report", c.Report.validate())
+
+	if c.APIVersion != "" {
+		log.Warning("global setting 'api-version' is deprecated, " +
+			"use relay config section 'docker' instead")
+		if c.Docker == nil {
+			c.Docker = &docker.RelayConfig{}
+		}
+		if c.Docker.APIVersion == "" {
+			c.Docker.APIVersion = c.APIVersion
+		}
+	}
+
+	for ix, t := range c.Tasks {
+		key := fmt.Sprintf("tasks.%d", ix)
+		if t == nil {
+			errs = errs.add(key, errors.New("task is empty"))
+			continue
+		}
+		if t.Relay == "" {
+			t.Relay = c.Relay
+		}
+		errs = append(errs, t.validate().within(key)...)
+		// the global retry settings were already checked above, so tasks
+		// only get them after validation
+		if t.Retry == nil {
+			t.Retry = c.Retry
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// task returns the task with name, or nil if there is none
+func (c *syncConfig) task(name string) *task {
 	for _, t := range c.Tasks {
-		if err := t.validate(); err != nil {
-			return err
+		if t.Name == name {
+			return t
 		}
 	}
 	return nil
 }
 
+// relays returns the IDs of all relays used by the tasks in this config
+func (c *syncConfig) relays() []string {
+	return taskRelays(c.Tasks)
+}
+
+// taskRelays returns the IDs of all relays used by tasks
+func taskRelays(tasks []*task) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, t := range tasks {
+		if !seen[t.Relay] {
+			seen[t.Relay] = true
+			ret = append(ret, t.Relay)
+		}
+	}
+	return ret
+}
+
+//
+func validateRelay(relay string) error {
+	switch relay {
+	case docker.RelayID, skopeo.RelayID, registry.RelayID:
+		return nil
+	}
+	return fmt.Errorf(
+		"invalid relay type: '%s', must be one of '%s', '%s', or '%s'",
+		relay, docker.RelayID, skopeo.RelayID, registry.RelayID)
+}
+
 /* ----------------------------------------------------------------------------
  *
  */
 type task struct {
-	Name             string     `yaml:"name"`
-	Interval         int        `yaml:"interval"`
-	Source           *location  `yaml:"source"`
-	Target           *location  `yaml:"target"`
-	Mappings         []*mapping `yaml:"mappings"`
-	SkipExistingTags bool       `yaml:"skipExistingTags"`
-	Verbose          bool       `yaml:"verbose"`
+	Name              string        `yaml:"name"`
+	Relay             string        `yaml:"relay"`
+	Interval          int           `yaml:"interval"`
+	Schedule          string        `yaml:"schedule"`
+	Timezone          string        `yaml:"timezone"`
+	Jitter            time.Duration `yaml:"jitter"`
+	RunOnStart        *bool         `yaml:"runOnStart"`
+	Source            *location     `yaml:"source"`
+	Target            *target       `yaml:"target"`
+	Targets           []*target     `yaml:"targets"`
+	Mappings          []*mapping    `yaml:"mappings"`
+	SkipExistingTags  bool          `yaml:"skipExistingTags"`
+	SkipUnchangedTags bool          `yaml:"skipUnchangedTags"`
+	Prune             bool          `yaml:"prune"`
+	PruneProtect      []string      `yaml:"prune-protect"`
+	PruneDryRun       bool          `yaml:"prune-dry-run"`
+	Parallelism       int           `yaml:"parallelism"`
+	Retry             *retry        `yaml:"retry"`
+	Verbose           bool          `yaml:"verbose"`
 	//
-	ticker   *time.Ticker
-	lastTick time.Time
-	failed   bool
+	sched   *cron.Schedule
+	running bool
+	failed  bool
+	// number of consecutive runs with errors
+	failedRuns int
+	mutex      gosync.Mutex
 }
 
-//
-func (t *task) validate() error {
+// validate checks this task and its mappings, and returns all problems found
+func (t *task) validate() configErrors {
+
+	var errs configErrors
 
 	if len(t.Name) == 0 {
-		return errors.New("a task requires a name")
+		errs = errs.add("name", errors.New("a task requires a name"))
 	}
 
+	errs = errs.add("relay", validateRelay(t.Relay))
+
 	if 0 < t.Interval && t.Interval < minimumTaskInterval {
-		return fmt.Errorf(
-			"minimum task interval is %d seconds", minimumTaskInterval)
+		errs = errs.add("interval", fmt.Errorf(
+			"minimum task interval is %d seconds", minimumTaskInterval))
 	}
 
 	if t.Interval < 0 {
-		return errors.New("task interval needs to be 0 or a positive integer")
+		errs = errs.add("interval", errors.New(
+			"task interval needs to be 0 or a positive integer"))
+	}
+
+	errs = append(errs, t.validateSchedule()...)
+
+	if t.Parallelism < 0 {
+		errs = errs.add("parallelism", errors.New(
+			"parallelism needs to be 0 or a positive integer"))
+	}
+
+	errs = errs.add("retry", t.Retry.validate())
+
+	if t.SkipExistingTags && t.SkipUnchangedTags {
+		errs = errs.add("skipUnchangedTags", errors.New(
+			"'skipExistingTags' and 'skipUnchangedTags' cannot be used "+
+				"together"))
 	}
 
 	if err := t.Source.validate(); err != nil {
-		return fmt.Errorf(
-			"source registry in task '%s' invalid: %v", t.Name, err)
+		errs = errs.add("source",
+			fmt.Errorf("source registry invalid: %v", err))
 	}
 
-	if err := t.Target.validate(); err != nil {
-		return fmt.Errorf(
-			"target registry in task '%s' invalid: %v", t.Name, err)
+	if t.Target != nil {
+		if len(t.Targets) > 0 {
+			errs = errs.add("target", errors.New(
+				"can have either 'target' or 'targets'"))
+		} else {
+			if err := t.Target.validate(); err != nil {
+				errs = errs.add("target",
+					fmt.Errorf("target registry invalid: %v", err))
+			}
+			t.Targets = []*target{t.Target}
+			t.Target = nil
+		}
+
+	} else if len(t.Targets) == 0 {
+		errs = errs.add("targets", errors.New("no target registry"))
+
+	} else {
+		for ix, trgt := range t.Targets {
+			if err := trgt.validate(); err != nil {
+				errs = errs.add(fmt.Sprintf("targets.%d", ix),
+					fmt.Errorf("target registry invalid: %v", err))
+			}
+		}
 	}
 
-	for _, m := range t.Mappings {
-		if err := m.validate(); err != nil {
-			return err
+	errs = errs.add("prune-protect", validateProtect(t.PruneProtect))
+
+	for ix, m := range t.Mappings {
+		mErrs := m.validate()
+		if m != nil {
+			if prune, _ := t.prune(m); prune && t.Relay == docker.RelayID {
+				mErrs = mErrs.add("prune", fmt.Errorf(
+					"%s relay cannot prune target tags", t.Relay))
+			}
+			mErrs = mErrs.add("platforms", m.Platforms.supportedBy(t.Relay))
+			if m.From != "" && !m.isPattern() {
+				m.From = normalizePath(m.From)
+			}
+			if m.To != "" {
+				m.To = normalizePath(m.To)
+			}
 		}
-		m.From = normalizePath(m.From)
-		m.To = normalizePath(m.To)
+		errs = append(errs, mErrs.within(fmt.Sprintf("mappings.%d", ix))...)
 	}
 
-	return nil
+	return errs
 }
 
-//
-func (t *task) startTicking(c chan *task) {
+// validateSchedule checks the settings for when the task runs, and parses
+// the schedule, if any
+func (t *task) validateSchedule() configErrors {
 
-	i := time.Duration(t.Interval)
+	var errs configErrors
+	t.sched = nil
 
-	if i == 0 {
-		i = 3
+	if t.Schedule == "" {
+		if t.Timezone != "" {
+			errs = errs.add("timezone",
+				errors.New("'timezone' requires a 'schedule'"))
+		}
+	} else if t.Interval > 0 {
+		errs = errs.add("schedule",
+			errors.New("can have either 'interval' or 'schedule'"))
+	} else {
+		loc := time.Local
+		if t.Timezone != "" {
+			var err error
+			if loc, err = time.LoadLocation(t.Timezone); err != nil {
+				errs = errs.add("timezone",
+					fmt.Errorf("invalid timezone: %v", err))
+				loc = time.Local
+			}
+		}
+		if sched, err := cron.Parse(t.Schedule, loc); err != nil {
+			errs = errs.add("schedule", err)
+		} else if sched.Next(time.Now()).IsZero() {
+			errs = errs.add("schedule",
+				fmt.Errorf("schedule '%s' is never due", t.Schedule))
+		} else {
+			t.sched = sched
+		}
 	}
 
-	t.ticker = time.NewTicker(time.Second * i)
-	t.lastTick = time.Now().Add(time.Second * i * (-2))
+	if t.Jitter < 0 {
+		errs = errs.add("jitter", errors.New("jitter cannot be negative"))
+	} else if t.Jitter > 0 && !t.isPeriodic() {
+		errs = errs.add("jitter",
+			errors.New("jitter requires an 'interval' or 'schedule'"))
+	}
 
-	go func() {
-		// fire once right at the start
-		c <- t
-		for range t.ticker.C {
-			c <- t
-		}
-	}()
+	return errs
 }
 
 //
-func (t *task) tooSoon() bool {
-	i := time.Duration(t.Interval)
-	if i == 0 {
-		return false
+func (t *task) isPeriodic() bool {
+	return t.Interval > 0 || t.Schedule != ""
+}
+
+// runOnStart returns true if a periodic task should also run right at start,
+// which by default is only the case for tasks with an interval
+func (t *task) runOnStart() bool {
+	if t.RunOnStart != nil {
+		return *t.RunOnStart
 	}
-	return time.Now().Before(t.lastTick.Add(time.Second * i / 2))
+	return t.Schedule == ""
 }
 
-//
-func (t *task) stopTicking(c chan *task) {
-	if t.ticker != nil {
-		t.ticker.Stop()
-		t.ticker = nil
+// nextRun returns when a periodic task is due next after the run that was due
+// at last, not including jitter. If that has already passed, e.g. because the
+// system was suspended, the next run is determined starting from now.
+func (t *task) nextRun(last time.Time) time.Time {
+	next := func(from time.Time) time.Time {
+		if t.sched != nil {
+			return t.sched.Next(from)
+		}
+		return from.Add(time.Second * time.Duration(t.Interval))
+	}
+	ret := next(last)
+	if now := time.Now(); ret.Before(now) {
+		ret = next(now)
+	}
+	return ret
+}
+
+// jitter returns a random delay of up to the task's jitter
+func (t *task) jitter() time.Duration {
+	if t.Jitter <= 0 {
+		return 0
 	}
+	return time.Duration(rand.Int63n(int64(t.Jitter)))
+}
+
+// tryStart marks the task as running, and returns true, unless it is already
+// running
+func (t *task) tryStart() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.running {
+		return false
+	}
+	t.running = true
+	return true
 }
 
 //
+func (t *task) done() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.running = false
+}
+
+// fail marks the task as failed if f is set; mappings of a task may be synced
+// concurrently, so access is synchronized
 func (t *task) fail(f bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	t.failed = t.failed || f
 }
 
 //
-func (t *task) mappingRefs(m *mapping) (from, to string) {
+func (t *task) hasFailed() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.failed
+}
+
+// countRun updates the number of consecutive failed runs once a run is done
+func (t *task) countRun() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.failed {
+		t.failedRuns++
+	} else {
+		t.failedRuns = 0
+	}
+}
+
+//
+func (t *task) consecutiveFailures() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.failedRuns
+}
+
+// mappingRefs returns the source ref for mapping m, and the ref for each of
+// the task's targets
+func (t *task) mappingRefs(m *mapping) (from string, to []string) {
 	if m != nil {
 		from = t.Source.Registry + m.From
-		to = t.Target.Registry + m.To
+		for _, trgt := range t.Targets {
+			to = append(to, trgt.Registry+trgt.Prefix+m.To)
+		}
 	}
 	return from, to
 }
 
 //
-func (t *task) ensureTargetExists(ref string) error {
+func (t *task) targetRegistries() []string {
+	var ret []string
+	for _, trgt := range t.Targets {
+		ret = append(ret, trgt.Registry+trgt.Prefix)
+	}
+	return ret
+}
+
+// expandMappings returns the mappings of this task, with mappings that are
+// regular expressions replaced by the mappings for the source repositories
+// they match. The source repositories are listed for every call, so that new
+// repositories get picked up. When listing fails, the mappings that could be
+// determined are returned along with the error.
+func (t *task) expandMappings(ctx context.Context, lg *log.Logger,
+	certsDir string) ([]*mapping, error) {
+
+	var ret []*mapping
+	var repos []string
+
+	for _, m := range t.Mappings {
+
+		if !m.isPattern() {
+			ret = append(ret, m)
+			continue
+		}
+
+		if repos == nil {
+			var err error
+			if repos, err = t.Source.listRepositories(ctx, certsDir); err != nil {
+				return ret, fmt.Errorf(
+					"error listing source repositories: %v", err)
+			}
+		}
+
+		expanded, err := m.expand(repos)
+		if err != nil {
+			return ret, err
+		}
+		lg.With(log.Fields{"mapping": m.From}).Info(
+			"mapping matches %d repositories", len(expanded))
+		ret = append(ret, expanded...)
+	}
+
+	return ret, nil
+}
+
+//
+func (t *task) ensureTargetExists(lg *log.Logger, trgt *target,
+	ref string) error {
 
-	isEcr, region, account := t.Target.getECR()
+	isEcr, region, account := trgt.getECR()
 
 	if isEcr {
 
@@ -183,7 +519,7 @@ func (t *task) ensureTargetExists(ref string) error {
 
 		out, err := svc.DescribeRepositories(inpDescr)
 		if err == nil && len(out.Repositories) > 0 {
-			log.Info("target '%s' already exists", ref)
+			lg.With(log.Fields{"target": ref}).Info("target already exists")
 			return nil
 		}
 
@@ -197,7 +533,7 @@ func (t *task) ensureTargetExists(ref string) error {
 			}
 		}
 
-		log.Info("creating target '%s'", ref)
+		lg.With(log.Fields{"target": ref}).Info("creating target")
 		inpCrea := &ecr.CreateRepositoryInput{
 			RepositoryName: aws.String(path),
 		}
@@ -226,6 +562,7 @@ type location struct {
 	Auth          string         `yaml:"auth"`
 	SkipTLSVerify bool           `yaml:"skip-tls-verify"`
 	AuthRefresh   *time.Duration `yaml:"auth-refresh"`
+	Parallelism   int            `yaml:"parallelism"`
 	lastRefresh   time.Time
 }
 
@@ -240,6 +577,10 @@ func (l *location) validate() error {
 		return errors.New("registry not set")
 	}
 
+	if l.Parallelism < 0 {
+		return errors.New("parallelism needs to be 0 or a positive integer")
+	}
+
 	l.lastRefresh = time.Time{}
 
 	if l.AuthRefresh != nil {
@@ -263,6 +604,139 @@ func (l *location) validate() error {
 	return nil
 }
 
+// listRepositories returns the paths of all repositories in this registry,
+// using the ECR API for ECR, and the registry's catalog otherwise
+func (l *location) listRepositories(ctx context.Context, certsDir string) (
+	[]string, error) {
+
+	isEcr, region, account := l.getECR()
+
+	if !isEcr {
+		if err := l.refreshAuth(); err != nil {
+			return nil, err
+		}
+		return registry.ListRepositories(ctx,
+			l.Registry, l.Auth, l.SkipTLSVerify, certsDir)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	svc := ecr.New(sess, &aws.Config{
+		Region: aws.String(region),
+	})
+
+	var ret []string
+	err = svc.DescribeRepositoriesPagesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId: aws.String(account),
+	}, func(out *ecr.DescribeRepositoriesOutput, last bool) bool {
+		for _, r := range out.Repositories {
+			ret = append(ret, aws.StringValue(r.RepositoryName))
+		}
+		return true
+	})
+
+	return ret, err
+}
+
+/* ----------------------------------------------------------------------------
+ *
+ */
+type serverConfig struct {
+	// address to listen on, as host:port
+	Listen string `yaml:"listen"`
+	// number of consecutive failed runs of a task tolerated before no longer
+	// reporting ready
+	ToleratedFailures int `yaml:"tolerated-failures"`
+}
+
+//
+func (s *serverConfig) validate() error {
+
+	if s == nil {
+		return nil
+	}
+
+	if s.Listen == "" {
+		s.Listen = defaultServerListen
+	}
+
+	if s.ToleratedFailures < 0 {
+		return errors.New(
+			"tolerated-failures needs to be 0 or a positive integer")
+	}
+
+	if _, _, err := net.SplitHostPort(s.Listen); err != nil {
+		return fmt.Errorf("invalid server listen address '%s': %v",
+			s.Listen, err)
+	}
+
+	return nil
+}
+
+/* ----------------------------------------------------------------------------
+ *
+ */
+type reportConfig struct {
+	// one of 'json' or 'junit'; defaults to 'json'
+	Format string `yaml:"format"`
+	// file for the report of the latest task run, or directory for writing a
+	// report file per task run
+	Path string `yaml:"path"`
+}
+
+//
+func (r *reportConfig) validate() error {
+
+	if r == nil {
+		return nil
+	}
+
+	if r.Path == "" {
+		return errors.New("report path not set")
+	}
+
+	switch r.Format {
+	case "":
+		r.Format = reportJSON
+	case reportJSON, reportJUnit:
+	default:
+		return fmt.Errorf(
+			"invalid report format '%s', must be one of '%s' or '%s'",
+			r.Format, reportJSON, reportJUnit)
+	}
+
+	return nil
+}
+
+/* ----------------------------------------------------------------------------
+ *
+ */
+type target struct {
+	location `yaml:",inline"`
+	// path prepended to the target paths of all mappings for this target
+	Prefix string `yaml:"prefix"`
+}
+
+//
+func (t *target) validate() error {
+
+	if t == nil {
+		return errors.New("target is nil")
+	}
+
+	if err := t.location.validate(); err != nil {
+		return err
+	}
+
+	if t.Prefix = strings.TrimSuffix(t.Prefix, "/"); t.Prefix != "" {
+		t.Prefix = normalizePath(t.Prefix)
+	}
+	return nil
+}
+
 //
 func (l *location) isECR() bool {
 	ecr, _, _ := l.getECR()
@@ -291,8 +765,17 @@ func (l *location) refreshAuth() error {
 		return nil
 	}
 
+	err := l.fetchECRAuth()
+	authRefreshes.Inc(l.Registry, result(err))
+	return err
+}
+
+//
+func (l *location) fetchECRAuth() error {
+
 	_, region, account := l.getECR()
-	log.Info("refreshing credentials for '%s'", l.Registry)
+	log.With(log.Fields{"registry": l.Registry}).Info(
+		"refreshing credentials")
 
 	sess, err := session.NewSession()
 
@@ -343,14 +826,39 @@ func (l *location) refreshAuth() error {
  *
  */
 type mapping struct {
-	From        string   `yaml:"from"`
-	To          string   `yaml:"to"`
-	Tags        []string `yaml:"tags"`
-	ExcludeTags []string `yaml:"excludeTags"`
+	From         string    `yaml:"from"`
+	To           string    `yaml:"to"`
+	Tags         []string  `yaml:"tags"`
+	ExcludeTags  []string  `yaml:"excludeTags"`
+	Latest       int       `yaml:"latest"`
+	SortBy       string    `yaml:"sortBy"`
+	MinAge       age       `yaml:"minAge"`
+	MaxAge       age       `yaml:"maxAge"`
+	Platforms    platforms `yaml:"platforms"`
+	Prune        *bool     `yaml:"prune"`
+	PruneProtect []string  `yaml:"prune-protect"`
 }
 
 func isValidTag(tag string) error {
-	validTag, err := regexp.Compile(`^(<|<=|>|>=)*[0-9A-Za-z_.\-*]+$`)
+
+	if tags.IsRegex(tag) {
+		_, err := tags.CompileRegex(tag)
+		return err
+	}
+
+	if tags.IsRange(tag) {
+		for _, constraint := range strings.Fields(tag) {
+			if tags.GetComparisonOperator(constraint) == "" {
+				return errors.New(fmt.Sprintf("constraint %s in range %s lacks a comparison operator", constraint, tag))
+			}
+			if err := isValidTag(constraint); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	validTag, err := regexp.Compile(`^(<|<=|>|>=|~|\^)?[0-9A-Za-z_.\-*]+$`)
 	if err != nil {
 		return err
 	}
@@ -358,33 +866,342 @@ func isValidTag(tag string) error {
 		return errors.New(fmt.Sprintf("tag %s contains unexpected characters", tag))
 	}
 
-	if tags.GetComparisonOperator(tag) != "" && strings.Contains(tag, "*") {
+	op := tags.GetComparisonOperator(tag)
+	if op != "" && strings.Contains(tag, "*") {
 		return errors.New(fmt.Sprintf("can not have wildcard in tag %s since it uses a comparison operator", tag))
 	}
 
+	if (op == "~" || op == "^") && !tags.IsSemver(tag[1:]) {
+		return errors.New(fmt.Sprintf("tag %s needs a semantic version for operator %s", tag, op))
+	}
+
 	return nil
 }
 
-//
-func (m *mapping) validate() error {
+// validate checks this mapping, and returns all problems found
+func (m *mapping) validate() configErrors {
+
+	var errs configErrors
+
 	if m == nil {
-		return errors.New("mapping is nil")
+		return errs.add("", errors.New("mapping is empty"))
 	}
 
 	if m.From == "" {
-		return errors.New("mapping without 'From' path")
+		errs = errs.add("from", errors.New("mapping without 'From' path"))
+	} else if m.isPattern() {
+		if _, _, err := m.pattern(); err != nil {
+			errs = errs.add("from", fmt.Errorf("not valid: %v", err))
+		}
+	} else if m.To == "" {
+		m.To = m.From
+	}
+
+	for ix, tag := range m.Tags {
+		if err := isValidTag(tag); err != nil {
+			errs = errs.add(fmt.Sprintf("tags.%d", ix),
+				fmt.Errorf("tag %s not valid: %v", tag, err))
+		}
+	}
+
+	for ix, tag := range m.ExcludeTags {
+		if err := isValidTag(tag); err != nil {
+			errs = errs.add(fmt.Sprintf("excludeTags.%d", ix),
+				fmt.Errorf("exclude tag %s not valid: %v", tag, err))
+		}
+	}
+
+	errs = errs.add("prune-protect", validateProtect(m.PruneProtect))
+
+	if m.Latest < 0 {
+		errs = errs.add("latest",
+			errors.New("'latest' needs to be 0 or a positive integer"))
+	}
+
+	errs = errs.add("sortBy", tags.ValidateSortBy(m.SortBy))
+
+	if m.MinAge < 0 || m.MaxAge < 0 {
+		key := "minAge"
+		if m.MinAge >= 0 {
+			key = "maxAge"
+		}
+		errs = errs.add(key,
+			errors.New("'minAge' and 'maxAge' cannot be negative"))
+	} else if m.MinAge > 0 && m.MaxAge > 0 && m.MinAge >= m.MaxAge {
+		errs = errs.add("minAge", fmt.Errorf(
+			"'minAge' (%s) needs to be less than 'maxAge' (%s)",
+			time.Duration(m.MinAge), time.Duration(m.MaxAge)))
+	}
+
+	return errs.add("platforms", m.Platforms.validate())
+}
+
+// isRegex returns true if the source of this mapping is a regular expression
+// matched against the repositories in the source registry
+func (m *mapping) isRegex() bool {
+	return tags.IsRegex(m.From)
+}
+
+// isGlob returns true if the source of this mapping contains wildcards; '*'
+// and '?' match within a path element, '**' matches across elements
+func (m *mapping) isGlob() bool {
+	return !m.isRegex() && strings.ContainsAny(m.From, "*?")
+}
+
+// isPattern returns true if this mapping needs to be expanded against the
+// repositories in the source registry
+func (m *mapping) isPattern() bool {
+	return m.isRegex() || m.isGlob()
+}
+
+// pattern returns the regular expression for matching source repositories,
+// and the template for the target path. A glob is turned into a regular
+// expression capturing everything after its literal prefix, i.e. the path
+// elements before the first wildcard, which is replaced with 'to'.
+func (m *mapping) pattern() (*regexp.Regexp, string, error) {
+
+	if m.isRegex() {
+		re, err := tags.CompileRegex(m.From)
+		return re, m.To, err
+	}
+
+	glob := strings.TrimPrefix(m.From, "/")
+	prefix := ""
+	if ix := strings.LastIndex(
+		glob[:strings.IndexAny(glob, "*?")], "/"); ix != -1 {
+		prefix = glob[:ix+1]
+	}
+
+	re, err := tags.CompileRegex(fmt.Sprintf("%s^%s(%s)$", tags.RegexPrefix,
+		regexp.QuoteMeta(prefix), globToRegex(glob[len(prefix):])))
+	if err != nil {
+		return nil, "", err
 	}
 
 	if m.To == "" {
-		m.To = m.From
+		return re, "", nil
+	}
+	return re, strings.TrimSuffix(m.To, "/") + "/${1}", nil
+}
+
+//
+func globToRegex(glob string) string {
+	var sb strings.Builder
+	for ix := 0; ix < len(glob); ix++ {
+		switch c := glob[ix]; {
+		case c == '*' && ix+1 < len(glob) && glob[ix+1] == '*':
+			sb.WriteString(".*")
+			ix++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// expand returns a copy of this mapping for each of repos that is matched by
+// the mapping's pattern, with the target path expanded from its template;
+// without a template, the repository path is kept
+func (m *mapping) expand(repos []string) ([]*mapping, error) {
+
+	re, to, err := m.pattern()
+	if err != nil {
+		return nil, err
 	}
 
-	for _, tag := range m.Tags {
-		if isValidTag(tag) != nil {
-			return errors.New(fmt.Sprintf("tag %s not valid", tag))
+	var ret []*mapping
+	for _, repo := range repos {
+		match := re.FindStringSubmatchIndex(repo)
+		if match == nil {
+			continue
+		}
+		e := *m
+		e.From = normalizePath(repo)
+		if to == "" {
+			e.To = e.From
+		} else {
+			e.To = normalizePath(string(re.ExpandString(nil, to, repo, match)))
 		}
+		ret = append(ret, &e)
 	}
 
+	return ret, nil
+}
+
+//
+func validateProtect(patterns []string) error {
+	for _, tag := range patterns {
+		if err := isValidTag(tag); err != nil {
+			return fmt.Errorf("prune-protect tag %s not valid: %v", tag, err)
+		}
+	}
+	return nil
+}
+
+// prune returns whether target tags should be pruned for mapping m, and if so,
+// which tags are protected from it
+func (t *task) prune(m *mapping) (bool, []string) {
+	prune := t.Prune
+	if m.Prune != nil {
+		prune = *m.Prune
+	}
+	if !prune {
+		return false, nil
+	}
+	return true, append(append([]string{}, t.PruneProtect...),
+		m.PruneProtect...)
+}
+
+/* ----------------------------------------------------------------------------
+ *
+ */
+type retry struct {
+	Attempts int           `yaml:"attempts"`
+	Delay    time.Duration `yaml:"delay"`
+	MaxDelay time.Duration `yaml:"max-delay"`
+}
+
+//
+func (r *retry) validate() error {
+
+	if r == nil {
+		return nil
+	}
+
+	if r.Attempts < 0 || r.Delay < 0 || r.MaxDelay < 0 {
+		return errors.New("retry settings cannot be negative")
+	}
+
+	if r.Delay == 0 {
+		r.Delay = defaultRetryDelay
+	}
+	if r.MaxDelay == 0 {
+		r.MaxDelay = defaultRetryMaxDelay
+	}
+	if r.MaxDelay < r.Delay {
+		return fmt.Errorf("retry max-delay %s is less than delay %s",
+			r.MaxDelay, r.Delay)
+	}
+
+	return nil
+}
+
+// policy returns the relays' retry policy for these settings, nil when
+// nothing should be retried
+func (r *retry) policy() *relays.RetryPolicy {
+	if r == nil || r.Attempts == 0 {
+		return nil
+	}
+	return &relays.RetryPolicy{
+		Attempts: r.Attempts,
+		Delay:    r.Delay,
+		MaxDelay: r.MaxDelay,
+	}
+}
+
+/* ----------------------------------------------------------------------------
+ *
+ */
+type age time.Duration
+
+// UnmarshalYAML accepts a Go duration such as '36h', or a number of days such
+// as '90d'
+func (a *age) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(str, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(str, "d"))
+		if err != nil {
+			return fmt.Errorf("invalid age '%s': %v", str, err)
+		}
+		*a = age(time.Duration(days) * 24 * time.Hour)
+		return nil
+	}
+
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return fmt.Errorf("invalid age '%s': %v", str, err)
+	}
+	*a = age(d)
+	return nil
+}
+
+/* ----------------------------------------------------------------------------
+ *
+ */
+type platforms []string
+
+// UnmarshalYAML accepts platforms either as a list, or as a single string of
+// comma separated platforms
+func (p *platforms) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*p = list
+		return nil
+	}
+
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	*p = nil
+	for _, pf := range strings.Split(str, ",") {
+		if pf = strings.TrimSpace(pf); pf != "" {
+			*p = append(*p, pf)
+		}
+	}
+	return nil
+}
+
+//
+func (p platforms) all() bool {
+	return len(p) == 1 && p[0] == relays.PlatformAll
+}
+
+//
+func (p platforms) validate() error {
+	for _, pf := range p {
+		if pf == relays.PlatformAll {
+			if len(p) > 1 {
+				return fmt.Errorf(
+					"platform '%s' cannot be combined with other platforms",
+					relays.PlatformAll)
+			}
+			continue
+		}
+		if _, err := relays.ParsePlatform(pf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supportedBy checks whether the platform selection can be handled by relay;
+// the registry relay supports any selection, while docker can only pull a
+// single platform, and skopeo can copy either a single or all platforms
+func (p platforms) supportedBy(relay string) error {
+	switch relay {
+	case docker.RelayID:
+		if p.all() || len(p) > 1 {
+			return fmt.Errorf(
+				"relay '%s' can only sync a single platform", relay)
+		}
+	case skopeo.RelayID:
+		if len(p) > 1 {
+			return fmt.Errorf(
+				"relay '%s' can only sync all or a single platform", relay)
+		}
+	}
 	return nil
 }
 
@@ -399,12 +1216,40 @@ func LoadConfig(file string) (*syncConfig, error) {
 		return nil, fmt.Errorf("error loading config file '%s': %v", file, err)
 	}
 
+	// the document is also kept as nodes, for finding the positions of
+	// problems, and the tasks and mappings they concern
+	var root yaml.Node
+	if err = yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("error parsing config file '%s': %v", file, err)
+	}
+
+	// decoding rejects unknown keys, e.g. misspelled settings, which would
+	// otherwise be silently ignored; such problems are reported along with
+	// those found during validation
+	var errs configErrors
 	config := &syncConfig{}
-	err = yaml.Unmarshal(data, config)
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(config); err != nil && err != io.EOF {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return nil, fmt.Errorf(
+				"error parsing config file '%s': %v", file, err)
+		}
+		errs = decodeErrors(typeErr, &root)
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("error parsing config file '%s': %v", file, err)
+	if err = config.validate(); err != nil {
+		if vErrs, ok := err.(configErrors); ok {
+			errs = append(errs, vErrs...)
+		} else {
+			errs = errs.add("", err)
+		}
 	}
 
-	return config, config.validate()
+	if len(errs) > 0 {
+		errs.locate(&root)
+		return config, errs
+	}
+	return config, nil
 }
@@ -1,6 +1,15 @@
 package sync
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
 
 func TestIsValidTag(t *testing.T) {
 	for _, testCase := range []struct {
@@ -35,6 +44,38 @@ func TestIsValidTag(t *testing.T) {
 			tag:   ">=v1.2.*", // no wildcard when using comparison operators
 			valid: false,
 		},
+		{
+			tag:   ">=1.2 <2.0",
+			valid: true,
+		},
+		{
+			tag:   ">=1.2 2.0", // each constraint in a range needs an operator
+			valid: false,
+		},
+		{
+			tag:   "~1.4",
+			valid: true,
+		},
+		{
+			tag:   "^v2",
+			valid: true,
+		},
+		{
+			tag:   "^latest", // needs semantic version
+			valid: false,
+		},
+		{
+			tag:   ">=stable", // compared lexically
+			valid: true,
+		},
+		{
+			tag:   `regex:^v\d+\.\d+\.\d+(-alpine)?$`,
+			valid: true,
+		},
+		{
+			tag:   `regex:^v(\d+$`,
+			valid: false,
+		},
 	} {
 		err := isValidTag(testCase.tag)
 		if testCase.valid && err != nil {
@@ -45,3 +86,807 @@ func TestIsValidTag(t *testing.T) {
 		}
 	}
 }
+
+func TestRelayValidation(t *testing.T) {
+	for _, testCase := range []struct {
+		relay  string
+		expect string
+		valid  bool
+	}{
+		{relay: "", expect: "skopeo", valid: true},
+		{relay: "skopeo", expect: "skopeo", valid: true},
+		{relay: "docker", expect: "docker", valid: true},
+		{relay: "registry", expect: "registry", valid: true},
+		{relay: "podman", valid: false},
+	} {
+		c := &syncConfig{Relay: testCase.relay}
+		err := c.validate()
+		if testCase.valid && err != nil {
+			t.Errorf("relay '%s' should be valid, got %s", testCase.relay, err)
+		}
+		if !testCase.valid && err == nil {
+			t.Errorf("relay '%s' should be invalid", testCase.relay)
+		}
+		if testCase.valid && c.Relay != testCase.expect {
+			t.Errorf("relay '%s' should resolve to '%s', got '%s'",
+				testCase.relay, testCase.expect, c.Relay)
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+
+	c := &syncConfig{
+		Relay:       "registry",
+		Parallelism: -1,
+		Retry:       &retry{Attempts: -1},
+		Tasks: []*task{
+			{Name: "t1", Source: &location{Registry: "source.acme.com"}},
+			{Name: "t2", Source: &location{Registry: "source.acme.com"},
+				Targets: []*target{{location: location{
+					Registry: "target.acme.com"}}},
+				Interval: -1},
+			{Name: "t3", Source: &location{Registry: "source.acme.com"},
+				Targets: []*target{{location: location{
+					Registry: "target.acme.com"}}},
+				Retry: &retry{Delay: -1}},
+		},
+	}
+
+	// all problems are reported, not just the first one, and invalid global
+	// retry settings only once, rather than for each task inheriting them
+	expected := []struct {
+		path string
+		msg  string
+	}{
+		{"parallelism", "parallelism needs to be 0 or a positive integer"},
+		{"retry", "retry settings cannot be negative"},
+		{"tasks.0.targets", "no target registry"},
+		{"tasks.1.interval",
+			"task interval needs to be 0 or a positive integer"},
+		{"tasks.2.retry", "retry settings cannot be negative"},
+	}
+
+	errs := ConfigErrors(c.validate())
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for ix, e := range expected {
+		err := errs[ix].(*configError)
+		if err.path != e.path || err.Error() != e.msg {
+			t.Errorf("expected '%s' at %s, got '%s' at %s", e.msg, e.path,
+				err.Error(), err.path)
+		}
+	}
+	if c.Tasks[0].Retry != c.Retry {
+		t.Error("task did not inherit global retry settings")
+	}
+
+	c = &syncConfig{Relay: "registry"}
+	if err := c.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// the main example in the README needs to be a valid config
+func TestReadmeConfig(t *testing.T) {
+
+	readme, err := ioutil.ReadFile("../../../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := strings.Index(string(readme), "```yaml\n")
+	if start < 0 {
+		t.Fatal("no config example in README")
+	}
+	start += len("```yaml\n")
+	end := strings.Index(string(readme[start:]), "```")
+	if end < 0 {
+		t.Fatal("config example in README not terminated")
+	}
+
+	f, err := ioutil.TempFile("", "dregsy-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(readme[start : start+end]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	conf, err := LoadConfig(f.Name())
+	if err != nil {
+		t.Fatalf("README config example invalid: %v", err)
+	}
+	if len(conf.Tasks) == 0 {
+		t.Error("README config example has no tasks")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "dregsy-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// unknown keys, problems in different mappings of a task, in flow style
+	// collections, and in settings merged in from an anchor
+	if _, err := f.WriteString(`relay: registry
+retry:
+  attempts: -1
+defaults: &defaults
+  source: {registry: source.acme.com, parallelism: -1}
+  target:
+    registry: target.acme.com
+tasks:
+- name: t1
+  source:
+    registry: source.acme.com
+  target: {registry: target.acme.com, prefx: mirror}
+  mappings:
+  - from: busybox
+    exludeTags:
+    - latest
+  - from: alpine
+    tags:
+    - '3.1'
+    - 'a$b'
+    latest: -1
+- <<: *defaults
+  interval: 10
+`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	_, err = LoadConfig(f.Name())
+	var msgs []string
+	for _, e := range ConfigErrors(err) {
+		msgs = append(msgs, e.Error())
+	}
+
+	expected := []string{
+		"line 4, column 1: field defaults not found in type sync.syncConfig",
+		"line 12, column 39: task 't1': " +
+			"field prefx not found in type sync.target",
+		"line 15, column 5: task 't1', mapping 'busybox': " +
+			"field exludeTags not found in type sync.mapping",
+		"line 2, column 1: retry settings cannot be negative",
+		"line 20, column 7: task 't1', mapping 'alpine': tag a$b not valid: " +
+			"tag a$b contains unexpected characters",
+		"line 21, column 5: task 't1', mapping 'alpine': " +
+			"'latest' needs to be 0 or a positive integer",
+		"line 22, column 3: task 2: a task requires a name",
+		"line 23, column 3: task 2: minimum task interval is 30 seconds",
+		"line 5, column 3: task 2: source registry invalid: " +
+			"parallelism needs to be 0 or a positive integer",
+	}
+	if !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"),
+			strings.Join(msgs, "\n"))
+	}
+}
+
+func TestDecodeErrorPositions(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "dregsy-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// unknown fields are reported at their key, even when the value starts
+	// on the same line, other problems at the outermost element of the line;
+	// durations require a unit
+	if _, err := f.WriteString(`relay: registry
+grace-period: 30
+tasks:
+- name: t1
+  source: {registry: source.acme.com}
+  target: {registry: target.acme.com}
+  mappings:
+  - from: busybox
+    exludeTags: ['x']
+  - {from: alpine, latest: many}
+`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	_, err = LoadConfig(f.Name())
+	var msgs []string
+	for _, e := range ConfigErrors(err) {
+		msgs = append(msgs, e.Error())
+	}
+
+	expected := []string{
+		"line 2, column 1: cannot unmarshal !!int `30` into time.Duration",
+		"line 9, column 5: task 't1', mapping 'busybox': " +
+			"field exludeTags not found in type sync.mapping",
+		"line 10, column 5: task 't1', mapping 'alpine': " +
+			"cannot unmarshal !!str `many` into int",
+	}
+	if !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"),
+			strings.Join(msgs, "\n"))
+	}
+}
+
+func TestTaskRelay(t *testing.T) {
+
+	newTask := func(name, relay string) *task {
+		return &task{
+			Name:   name,
+			Relay:  relay,
+			Source: &location{Registry: "source.acme.com"},
+			Target: &target{location: location{Registry: "target.acme.com"}},
+		}
+	}
+
+	c := &syncConfig{
+		Relay: "docker",
+		Tasks: []*task{
+			newTask("t1", ""),
+			newTask("t2", "skopeo"),
+			newTask("t3", "docker"),
+		},
+	}
+
+	if err := c.validate(); err != nil {
+		t.Fatalf("config should be valid, got %s", err)
+	}
+	if c.Tasks[0].Relay != "docker" {
+		t.Errorf("task should default to global relay, got '%s'",
+			c.Tasks[0].Relay)
+	}
+	if r := c.relays(); len(r) != 2 || r[0] != "docker" || r[1] != "skopeo" {
+		t.Errorf("unexpected relays in use: %v", r)
+	}
+
+	c.Tasks = append(c.Tasks, newTask("t4", "podman"))
+	if err := c.validate(); err == nil {
+		t.Error("task with invalid relay should not validate")
+	}
+}
+
+func TestSkipTags(t *testing.T) {
+
+	tk := &task{
+		Name:              "t1",
+		Relay:             "registry",
+		Source:            &location{Registry: "source.acme.com"},
+		Target:            &target{location: location{Registry: "target.acme.com"}},
+		SkipUnchangedTags: true,
+	}
+	if err := tk.validate(); err != nil {
+		t.Errorf("task should be valid, got %s", err)
+	}
+
+	tk.SkipExistingTags = true
+	if err := tk.validate(); err == nil {
+		t.Error("task skipping existing and unchanged tags should not validate")
+	}
+}
+
+func TestMappingExpand(t *testing.T) {
+
+	repos := []string{"library/busybox", "library/nginx", "acme/app"}
+
+	for _, testCase := range []struct {
+		mapping *mapping
+		expect  map[string]string
+	}{
+		{
+			mapping: &mapping{
+				From: "regex:^library/(.*)$", To: "mirror/dockerhub/$1"},
+			expect: map[string]string{
+				"/library/busybox": "/mirror/dockerhub/busybox",
+				"/library/nginx":   "/mirror/dockerhub/nginx",
+			},
+		},
+		{
+			mapping: &mapping{From: "regex:^acme/"},
+			expect:  map[string]string{"/acme/app": "/acme/app"},
+		},
+		{
+			mapping: &mapping{
+				From: "regex:^(\\w+)/(\\w+)$", To: "${2}-from-${1}"},
+			expect: map[string]string{
+				"/library/busybox": "/busybox-from-library",
+				"/library/nginx":   "/nginx-from-library",
+				"/acme/app":        "/app-from-acme",
+			},
+		},
+		{
+			mapping: &mapping{From: "library/*", To: "mirror/dockerhub"},
+			expect: map[string]string{
+				"/library/busybox": "/mirror/dockerhub/busybox",
+				"/library/nginx":   "/mirror/dockerhub/nginx",
+			},
+		},
+		{
+			mapping: &mapping{From: "/**"},
+			expect: map[string]string{
+				"/library/busybox": "/library/busybox",
+				"/library/nginx":   "/library/nginx",
+				"/acme/app":        "/acme/app",
+			},
+		},
+		{
+			mapping: &mapping{From: "*/a??", To: "mirror/"},
+			expect:  map[string]string{"/acme/app": "/mirror/acme/app"},
+		},
+	} {
+		tk := &task{
+			Name:     "t1",
+			Relay:    "registry",
+			Source:   &location{Registry: "source.acme.com"},
+			Target:   &target{location: location{Registry: "target.acme.com"}},
+			Mappings: []*mapping{testCase.mapping},
+		}
+		if err := tk.validate(); err != nil {
+			t.Fatalf("task should be valid, got %s", err)
+		}
+		expanded, err := testCase.mapping.expand(repos)
+		if err != nil {
+			t.Fatalf("error expanding mapping: %v", err)
+		}
+		got := make(map[string]string)
+		for _, m := range expanded {
+			got[m.From] = m.To
+		}
+		if !reflect.DeepEqual(got, testCase.expect) {
+			t.Errorf("mapping '%s' expanded to %v", testCase.mapping.From, got)
+		}
+	}
+
+	m := &mapping{From: "regex:^library/(.*"}
+	if err := m.validate(); err == nil {
+		t.Error("mapping with invalid regex should not validate")
+	}
+}
+
+func TestTargets(t *testing.T) {
+
+	tk := &task{}
+	if err := yaml.Unmarshal([]byte(`
+name: t1
+relay: registry
+source:
+  registry: source.acme.com
+targets:
+  - registry: eu.acme.com
+  - registry: us.acme.com
+    prefix: mirror/
+mappings:
+  - from: library/busybox
+`), tk); err != nil {
+		t.Fatalf("error parsing task: %v", err)
+	}
+	if err := tk.validate(); err != nil {
+		t.Fatalf("task should be valid, got %s", err)
+	}
+
+	from, to := tk.mappingRefs(tk.Mappings[0])
+	if from != "source.acme.com/library/busybox" || !reflect.DeepEqual(to,
+		[]string{"eu.acme.com/library/busybox",
+			"us.acme.com/mirror/library/busybox"}) {
+		t.Errorf("unexpected refs for mapping: %s, %v", from, to)
+	}
+
+	tk.Target = &target{location: location{Registry: "ap.acme.com"}}
+	if err := tk.validate(); err == nil {
+		t.Error("task with 'target' and 'targets' should not validate")
+	}
+
+	tk.Target = nil
+	tk.Targets = nil
+	if err := tk.validate(); err == nil {
+		t.Error("task without target should not validate")
+	}
+}
+
+func TestParallelism(t *testing.T) {
+
+	conf := &syncConfig{}
+	if err := yaml.Unmarshal([]byte(`
+relay: registry
+parallelism: 8
+tasks:
+  - name: t1
+    parallelism: 4
+    source:
+      registry: source.acme.com
+      parallelism: 2
+    target:
+      registry: target.acme.com
+    mappings:
+      - from: library/busybox
+  - name: t2
+    source:
+      registry: source.acme.com
+      parallelism: 3
+    target:
+      registry: target.acme.com
+    mappings:
+      - from: library/busybox
+`), conf); err != nil {
+		t.Fatalf("error parsing config: %v", err)
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("config should be valid, got %s", err)
+	}
+
+	l := newLimits(conf)
+	t1, t2 := conf.Tasks[0], conf.Tasks[1]
+	if p := l.taskParallelism(t1); p != 4 {
+		t.Errorf("expected parallelism 4 for t1, got %d", p)
+	}
+	if p := l.taskParallelism(t2); p != 8 {
+		t.Errorf("expected parallelism 8 for t2, got %d", p)
+	}
+	if c := cap(l.registries["source.acme.com"]); c != 2 {
+		t.Errorf("expected lowest registry limit 2, got %d", c)
+	}
+	if _, ok := l.registries["target.acme.com"]; ok {
+		t.Error("target registry should not be limited")
+	}
+
+	lim := l.limiter(t1, []string{"source.acme.com", "target.acme.com",
+		"source.acme.com"}).(*limiter)
+	if len(lim.sems) != 4 {
+		t.Errorf("expected 4 semaphores, got %d", len(lim.sems))
+	}
+	release := lim.Acquire()
+	if len(l.global) != 1 || len(l.tasks[t1]) != 1 ||
+		len(l.registries["source.acme.com"]) != 1 {
+		t.Error("semaphores not acquired")
+	}
+	release()
+	if len(l.global) != 0 || len(l.registries["source.acme.com"]) != 0 {
+		t.Error("semaphores not released")
+	}
+
+	conf.Parallelism = 0
+	t2.Source.Parallelism = 0
+	if l = newLimits(conf); l.limiter(t2, nil) != nil {
+		t.Error("task without parallelism should sync sequentially")
+	}
+
+	t1.Parallelism = -1
+	if err := t1.validate(); err == nil {
+		t.Error("negative parallelism should not validate")
+	}
+}
+
+func TestTaskSchedule(t *testing.T) {
+
+	tk := &task{
+		Name:     "t1",
+		Relay:    "registry",
+		Source:   &location{Registry: "source.acme.com"},
+		Target:   &target{location: location{Registry: "target.acme.com"}},
+		Schedule: "0 3 * * *",
+		Timezone: "UTC",
+		Jitter:   10 * time.Minute,
+	}
+	if err := tk.validate(); err != nil {
+		t.Fatalf("task should be valid, got %s", err)
+	}
+
+	if !tk.isPeriodic() || tk.runOnStart() {
+		t.Error("scheduled task should be periodic, and not run on start")
+	}
+
+	now := time.Now().UTC()
+	next := tk.nextRun(now)
+	if next.Hour() != 3 || next.Minute() != 0 || !next.After(now) ||
+		next.Sub(now) > 24*time.Hour {
+		t.Errorf("unexpected next run: %v", next)
+	}
+	// a run that would be due in the past is scheduled from now on
+	if past := tk.nextRun(now.Add(-72 * time.Hour)); !past.Equal(next) {
+		t.Errorf("expected next run %v, got %v", next, past)
+	}
+	for i := 0; i < 100; i++ {
+		if j := tk.jitter(); j < 0 || j >= tk.Jitter {
+			t.Fatalf("jitter out of range: %s", j)
+		}
+	}
+
+	tk.Schedule = ""
+	tk.Timezone = ""
+	tk.Interval = 60
+	if err := tk.validate(); err != nil {
+		t.Fatalf("task should be valid, got %s", err)
+	}
+	if !tk.runOnStart() {
+		t.Error("task with interval should run on start by default")
+	}
+	if next := tk.nextRun(now); !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected next run in a minute, got %v", next)
+	}
+
+	for _, modify := range []func(){
+		func() { tk.Schedule = "0 3 * * *" },
+		func() { tk.Timezone = "Europe/Berlin" },
+		func() { tk.Interval = 0; tk.Schedule = "0 3 * *" },
+		func() { tk.Interval = 0; tk.Schedule = "0 3 30 2 *" },
+		func() {
+			tk.Interval = 0
+			tk.Schedule = "0 3 * * *"
+			tk.Timezone = "Mars/Olympus_Mons"
+		},
+		func() { tk.Interval = 0; tk.Jitter = time.Minute },
+	} {
+		tk.Interval = 60
+		tk.Schedule = ""
+		tk.Timezone = ""
+		tk.Jitter = 0
+		modify()
+		if err := tk.validate(); err == nil {
+			t.Errorf("task should not validate: interval %d, schedule '%s', "+
+				"timezone '%s', jitter %s", tk.Interval, tk.Schedule,
+				tk.Timezone, tk.Jitter)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+
+	conf := &syncConfig{}
+	if err := yaml.Unmarshal([]byte(`
+relay: registry
+retry:
+  attempts: 3
+tasks:
+  - name: t1
+    source:
+      registry: source.acme.com
+    target:
+      registry: target.acme.com
+  - name: t2
+    source:
+      registry: source.acme.com
+    target:
+      registry: target.acme.com
+    retry:
+      attempts: 5
+      delay: 10s
+      max-delay: 5m
+`), conf); err != nil {
+		t.Fatalf("error parsing config: %v", err)
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("config should be valid, got %s", err)
+	}
+
+	if p := conf.Tasks[0].Retry.policy(); p == nil || p.Attempts != 3 ||
+		p.Delay != defaultRetryDelay || p.MaxDelay != defaultRetryMaxDelay {
+		t.Errorf("expected global retry settings with defaults, got %+v", p)
+	}
+	if p := conf.Tasks[1].Retry.policy(); p == nil || p.Attempts != 5 ||
+		p.Delay != 10*time.Second || p.MaxDelay != 5*time.Minute {
+		t.Errorf("unexpected task retry settings: %+v", p)
+	}
+	if p := (&retry{}).policy(); p != nil {
+		t.Error("no attempts should mean no retry policy")
+	}
+
+	conf.Tasks[1].Retry.MaxDelay = time.Second
+	if err := conf.Tasks[1].validate(); err == nil {
+		t.Error("max-delay less than delay should not validate")
+	}
+	conf.Tasks[1].Retry = &retry{Attempts: -1}
+	if err := conf.Tasks[1].validate(); err == nil {
+		t.Error("negative attempts should not validate")
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+
+	conf := &syncConfig{}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("config should be valid, got %s", err)
+	}
+	if *conf.GracePeriod != defaultGracePeriod {
+		t.Errorf("expected default grace period, got %s", *conf.GracePeriod)
+	}
+
+	conf = &syncConfig{}
+	if err := yaml.Unmarshal([]byte(`grace-period: 0s`), conf); err != nil {
+		t.Fatalf("error parsing config: %v", err)
+	}
+	if err := conf.validate(); err != nil || *conf.GracePeriod != 0 {
+		t.Errorf("zero grace period should be kept, got %v", err)
+	}
+
+	gp := -time.Second
+	conf = &syncConfig{GracePeriod: &gp}
+	if err := conf.validate(); err == nil {
+		t.Error("negative grace period should not validate")
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+
+	conf := &syncConfig{Server: &serverConfig{}}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("config should be valid, got %s", err)
+	}
+	if conf.Server.Listen != defaultServerListen {
+		t.Errorf("expected default listen address, got '%s'",
+			conf.Server.Listen)
+	}
+
+	conf = &syncConfig{Server: &serverConfig{Listen: "localhost"}}
+	if err := conf.validate(); err == nil {
+		t.Error("listen address without port should not validate")
+	}
+
+	conf = &syncConfig{Server: &serverConfig{ToleratedFailures: -1}}
+	if err := conf.validate(); err == nil {
+		t.Error("negative tolerated-failures should not validate")
+	}
+}
+
+func TestPrune(t *testing.T) {
+
+	off := false
+	tk := &task{
+		Name:         "t1",
+		Relay:        "skopeo",
+		Source:       &location{Registry: "source.acme.com"},
+		Target:       &target{location: location{Registry: "target.acme.com"}},
+		Prune:        true,
+		PruneProtect: []string{"stable"},
+		Mappings: []*mapping{
+			{From: "a", PruneProtect: []string{"regex:^release-"}},
+			{From: "b", Prune: &off},
+		},
+	}
+	if err := tk.validate(); err != nil {
+		t.Fatalf("task should be valid, got %s", err)
+	}
+
+	prune, protect := tk.prune(tk.Mappings[0])
+	if !prune || !reflect.DeepEqual(protect,
+		[]string{"stable", "regex:^release-"}) {
+		t.Errorf("unexpected prune settings for mapping: %v, %v",
+			prune, protect)
+	}
+	if prune, _ := tk.prune(tk.Mappings[1]); prune {
+		t.Error("mapping should override prune setting of task")
+	}
+
+	tk.Relay = "docker"
+	if err := tk.validate(); err == nil {
+		t.Error("docker relay should not support pruning")
+	}
+
+	tk.Relay = "skopeo"
+	tk.PruneProtect = []string{"regex:("}
+	if err := tk.validate(); err == nil {
+		t.Error("invalid prune-protect pattern should not validate")
+	}
+}
+
+func TestAge(t *testing.T) {
+	for _, testCase := range []struct {
+		yaml   string
+		minAge time.Duration
+		maxAge time.Duration
+		valid  bool
+	}{
+		{
+			yaml:   "{minAge: 36h, maxAge: 90d}",
+			minAge: 36 * time.Hour,
+			maxAge: 90 * 24 * time.Hour,
+			valid:  true,
+		},
+		{
+			yaml:   "{maxAge: 1h30m}",
+			maxAge: 90 * time.Minute,
+			valid:  true,
+		},
+		{
+			yaml:   "{minAge: 7d, maxAge: 1d}",
+			minAge: 7 * 24 * time.Hour,
+			maxAge: 24 * time.Hour,
+		},
+		{
+			yaml:   "{minAge: -1h}",
+			minAge: -time.Hour,
+		},
+	} {
+		m := &mapping{From: "a", To: "b"}
+		if err := yaml.Unmarshal([]byte(testCase.yaml), m); err != nil {
+			t.Fatalf("error parsing '%s': %v", testCase.yaml, err)
+		}
+		if time.Duration(m.MinAge) != testCase.minAge ||
+			time.Duration(m.MaxAge) != testCase.maxAge {
+			t.Errorf("'%s' parsed as %s, %s", testCase.yaml,
+				time.Duration(m.MinAge), time.Duration(m.MaxAge))
+		}
+		err := m.validate()
+		if testCase.valid && err != nil {
+			t.Errorf("'%s' should be valid, got %s", testCase.yaml, err)
+		}
+		if !testCase.valid && err == nil {
+			t.Errorf("'%s' should be invalid", testCase.yaml)
+		}
+	}
+
+	for _, invalid := range []string{"{maxAge: 3w}", "{minAge: xd}"} {
+		m := &mapping{}
+		if err := yaml.Unmarshal([]byte(invalid), m); err == nil {
+			t.Errorf("'%s' should not parse", invalid)
+		}
+	}
+}
+
+func TestPlatforms(t *testing.T) {
+	for _, testCase := range []struct {
+		yaml      string
+		expect    []string
+		valid     bool
+		supported map[string]bool
+	}{
+		{
+			yaml:      "platforms: all",
+			expect:    []string{"all"},
+			valid:     true,
+			supported: map[string]bool{"docker": false, "skopeo": true},
+		},
+		{
+			yaml:      "platforms: linux/amd64, linux/arm/v7",
+			expect:    []string{"linux/amd64", "linux/arm/v7"},
+			valid:     true,
+			supported: map[string]bool{"skopeo": false, "registry": true},
+		},
+		{
+			yaml:      "platforms: [linux/arm64]",
+			expect:    []string{"linux/arm64"},
+			valid:     true,
+			supported: map[string]bool{"docker": true, "skopeo": true},
+		},
+		{
+			yaml:   "platforms: [all, linux/arm64]",
+			expect: []string{"all", "linux/arm64"},
+		},
+		{
+			yaml:   "platforms: linux",
+			expect: []string{"linux"},
+		},
+	} {
+		m := &mapping{}
+		if err := yaml.Unmarshal([]byte(testCase.yaml), m); err != nil {
+			t.Fatalf("error parsing '%s': %v", testCase.yaml, err)
+		}
+		if !reflect.DeepEqual([]string(m.Platforms), testCase.expect) {
+			t.Errorf("'%s' parsed as %v", testCase.yaml, m.Platforms)
+		}
+		err := m.Platforms.validate()
+		if testCase.valid && err != nil {
+			t.Errorf("'%s' should be valid, got %s", testCase.yaml, err)
+		}
+		if !testCase.valid && err == nil {
+			t.Errorf("'%s' should be invalid", testCase.yaml)
+		}
+		for relay, supported := range testCase.supported {
+			err := m.Platforms.supportedBy(relay)
+			if supported && err != nil {
+				t.Errorf("'%s' should be supported by %s, got %s",
+					testCase.yaml, relay, err)
+			}
+			if !supported && err == nil {
+				t.Errorf("'%s' should not be supported by %s",
+					testCase.yaml, relay)
+			}
+		}
+	}
+}
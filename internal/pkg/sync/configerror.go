@@ -0,0 +1,307 @@
+/*
+ *
+ */
+
+package sync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configError is a problem found in a config, along with the path of the
+// offending element, e.g. 'tasks.0.mappings.1.tags.2', the task and mapping
+// it concerns, if any, and its position in the config file, where known
+type configError struct {
+	err     error
+	path    string
+	context []string
+	line    int
+	column  int
+}
+
+//
+func (e *configError) Error() string {
+	msg := e.err.Error()
+	if len(e.context) > 0 {
+		msg = fmt.Sprintf("%s: %s", strings.Join(e.context, ", "), msg)
+	}
+	if e.line > 0 && e.column > 0 {
+		msg = fmt.Sprintf("line %d, column %d: %s", e.line, e.column, msg)
+	} else if e.line > 0 {
+		msg = fmt.Sprintf("line %d: %s", e.line, msg)
+	}
+	return msg
+}
+
+// configErrors are all the problems found in a config
+type configErrors []*configError
+
+//
+func (e configErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for ix, err := range e {
+		msgs[ix] = "  - " + err.Error()
+	}
+	return fmt.Sprintf("%d errors in config:\n%s", len(e),
+		strings.Join(msgs, "\n"))
+}
+
+// add returns these errors plus err, found in the element at path, unless err
+// is nil
+func (e configErrors) add(path string, err error) configErrors {
+	if err == nil {
+		return e
+	}
+	return append(e, &configError{err: err, path: path})
+}
+
+// within returns these errors as found in the element at key of the element
+// they belong to
+func (e configErrors) within(key string) configErrors {
+	for _, err := range e {
+		err.path = joinPath(key, err.path)
+	}
+	return e
+}
+
+// locate sets the task and mapping each error concerns, and its position
+// unless already known, as found in the document root; errors whose element
+// is not in the document, e.g. because it's a default, get the position of
+// the closest enclosing element
+func (e configErrors) locate(root *yaml.Node) {
+
+	for _, err := range e {
+
+		if err.path == "" {
+			continue
+		}
+
+		var pos *yaml.Node
+		node := root
+		keys := strings.Split(err.path, ".")
+
+		for ix, key := range keys {
+			p, n := child(node, key)
+			if p == nil {
+				break
+			}
+			pos, node = p, n
+			if ctx := describe(keys[:ix+1], node); ctx != "" {
+				err.context = append(err.context, ctx)
+			}
+		}
+
+		if pos != nil && err.line == 0 {
+			err.line, err.column = pos.Line, pos.Column
+		}
+	}
+}
+
+// ConfigErrors returns the individual problems if err is the result of
+// loading or validating a config, and otherwise just err
+func ConfigErrors(err error) []error {
+	if errs, ok := err.(configErrors); ok {
+		ret := make([]error, len(errs))
+		for ix, e := range errs {
+			ret[ix] = e
+		}
+		return ret
+	}
+	return []error{err}
+}
+
+// decodeErrors turns the errors in err, found while decoding document root,
+// into configErrors, so that they can be reported along with the problems
+// found during validation. The decoder only gives the line of each problem,
+// so an unknown field is attributed to the key of that name on the line, and
+// other problems to the outermost element starting on that line.
+func decodeErrors(err *yaml.TypeError, root *yaml.Node) configErrors {
+
+	// the elements starting on each line, outermost first
+	lines := make(map[int][]*configError)
+	walkNodes(root, "", func(path string, n *yaml.Node) {
+		lines[n.Line] = append(lines[n.Line],
+			&configError{path: path, line: n.Line, column: n.Column})
+	})
+
+	var ret configErrors
+	for _, msg := range err.Errors {
+		e := &configError{}
+		var line int
+		if _, err := fmt.Sscanf(msg, "line %d:", &line); err == nil {
+			msg = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+			if el := elementOnLine(lines[line], msg); el != nil {
+				*e = *el
+			} else {
+				e.line = line
+			}
+		}
+		e.err = fmt.Errorf("%s", msg)
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+// elementOnLine returns the element among elements of a line the decoding
+// problem described by msg concerns, or nil if there are no elements
+func elementOnLine(elements []*configError, msg string) *configError {
+
+	if len(elements) == 0 {
+		return nil
+	}
+
+	var field string
+	if _, err := fmt.Sscanf(msg, "field %s not found", &field); err == nil {
+		for _, el := range elements {
+			if el.path == field || strings.HasSuffix(el.path, "."+field) {
+				return el
+			}
+		}
+	}
+
+	return elements[0]
+}
+
+//
+func joinPath(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	if child == "" {
+		return parent
+	}
+	return parent + "." + child
+}
+
+/* ----------------------------------------------------------------------------
+ * navigating the YAML document
+ */
+
+// walkNodes calls fn for each element below node, with its path, and the node
+// where it starts, i.e. the key for entries of a mapping; aliases are not
+// followed, since their elements are found where the anchor is
+func walkNodes(node *yaml.Node, path string, fn func(string, *yaml.Node)) {
+
+	switch node.Kind {
+
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			walkNodes(n, path, fn)
+		}
+
+	case yaml.MappingNode:
+		for ix := 0; ix+1 < len(node.Content); ix += 2 {
+			key, val := node.Content[ix], node.Content[ix+1]
+			p := joinPath(path, key.Value)
+			fn(p, key)
+			walkNodes(val, p, fn)
+		}
+
+	case yaml.SequenceNode:
+		for ix, n := range node.Content {
+			p := joinPath(path, strconv.Itoa(ix))
+			fn(p, n)
+			walkNodes(n, p, fn)
+		}
+	}
+}
+
+// child returns the element at key of node, i.e. an entry of a mapping, or an
+// item of a sequence given by its index, as the node where it starts, and the
+// node of its value; both are nil if there is no such element
+func child(node *yaml.Node, key string) (pos, val *yaml.Node) {
+
+	node = resolve(node)
+	if node == nil {
+		return nil, nil
+	}
+
+	switch node.Kind {
+
+	case yaml.MappingNode:
+		for ix := 0; ix+1 < len(node.Content); ix += 2 {
+			if node.Content[ix].Value == key {
+				return node.Content[ix], resolve(node.Content[ix+1])
+			}
+		}
+		// entries merged in from elsewhere
+		for ix := 0; ix+1 < len(node.Content); ix += 2 {
+			if node.Content[ix].ShortTag() != "!!merge" {
+				continue
+			}
+			merged := resolve(node.Content[ix+1])
+			if merged != nil && merged.Kind == yaml.SequenceNode {
+				for _, m := range merged.Content {
+					if p, v := child(m, key); p != nil {
+						return p, v
+					}
+				}
+			} else if p, v := child(merged, key); p != nil {
+				return p, v
+			}
+		}
+
+	case yaml.SequenceNode:
+		if ix, err := strconv.Atoi(key); err == nil &&
+			0 <= ix && ix < len(node.Content) {
+			return node.Content[ix], resolve(node.Content[ix])
+		}
+	}
+
+	return nil, nil
+}
+
+// resolve returns the node node stands for, i.e. the content of a document,
+// or the anchored node of an alias
+func resolve(node *yaml.Node) *yaml.Node {
+	for node != nil {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			if len(node.Content) == 0 {
+				return nil
+			}
+			node = node.Content[0]
+		case yaml.AliasNode:
+			node = node.Alias
+		default:
+			return node
+		}
+	}
+	return nil
+}
+
+// describe returns the task or mapping node at the element given by keys
+// stands for, e.g. "task 't1'", or an empty string for other elements
+func describe(keys []string, node *yaml.Node) string {
+
+	scalar := func(key string) string {
+		if _, v := child(node, key); v != nil && v.Kind == yaml.ScalarNode {
+			return v.Value
+		}
+		return ""
+	}
+
+	switch {
+
+	case len(keys) == 2 && keys[0] == "tasks":
+		if name := scalar("name"); name != "" {
+			return fmt.Sprintf("task '%s'", name)
+		}
+		ix, _ := strconv.Atoi(keys[1])
+		return fmt.Sprintf("task %d", ix+1)
+
+	case len(keys) == 4 && keys[0] == "tasks" && keys[2] == "mappings":
+		if from := scalar("from"); from != "" {
+			return fmt.Sprintf("mapping '%s'", from)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,108 @@
+/*
+ *
+ */
+
+package sync
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how long a scheduler may take to answer a probe before it's considered
+// unresponsive
+const probeTimeout = 5 * time.Second
+
+//
+func (s *sync) addProbe(task string, probe chan chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.probes == nil {
+		s.probes = make(map[string]chan chan struct{})
+	}
+	s.probes[task] = probe
+}
+
+//
+func (s *sync) removeProbe(task string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.probes, task)
+}
+
+// checkHealth returns the problems preventing dregsy from being healthy, i.e.
+// schedulers of periodic tasks that do not respond
+func (s *sync) checkHealth() []string {
+
+	s.mutex.Lock()
+	probes := make(map[string]chan chan struct{}, len(s.probes))
+	for task, probe := range s.probes {
+		probes[task] = probe
+	}
+	s.mutex.Unlock()
+
+	var ret []string
+	timeout := time.NewTimer(probeTimeout)
+	defer timeout.Stop()
+
+	for task, probe := range probes {
+		reply := make(chan struct{})
+		select {
+		case probe <- reply:
+			<-reply
+		case <-s.stopping:
+			// the scheduler may already be gone
+		case <-timeout.C:
+			ret = append(ret,
+				fmt.Sprintf("scheduler of task '%s' not responding", task))
+		}
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// checkReadiness returns the problems preventing dregsy from being ready: not
+// all relays prepared yet, tasks with more consecutive failed runs than
+// tolerated, or shutting down
+func (s *sync) checkReadiness(conf *syncConfig) []string {
+
+	var ret []string
+
+	s.mutex.Lock()
+	prepared := s.prepared
+	s.mutex.Unlock()
+	if !prepared {
+		ret = append(ret, "relays not prepared")
+	}
+
+	if s.isStopping() {
+		ret = append(ret, "shutting down")
+	}
+
+	for _, t := range conf.Tasks {
+		if f := t.consecutiveFailures(); f > conf.Server.ToleratedFailures {
+			ret = append(ret, fmt.Sprintf(
+				"task '%s' failed in last %d run(s)", t.Name, f))
+		}
+	}
+
+	return ret
+}
+
+// statusHandler responds with 200 and 'ok' if check doesn't return any
+// problems, and with 503 and the list of problems otherwise
+func statusHandler(check func() []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if problems := check(); len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
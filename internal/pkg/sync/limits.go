@@ -0,0 +1,164 @@
+/*
+ *
+ */
+
+package sync
+
+import (
+	"sort"
+
+	"github.com/yannh/dregsy/internal/pkg/relays"
+)
+
+// semaphore limits the number of concurrent activities; a nil semaphore
+// imposes no limit
+type semaphore chan struct{}
+
+//
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+//
+func (s semaphore) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+// tryAcquire acquires the semaphore if that's possible without blocking, and
+// returns whether it did
+func (s semaphore) tryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+//
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// limits holds the semaphores for the global, per task, and per registry
+// limits on how many tags are synced concurrently
+type limits struct {
+	parallelism int
+	global      semaphore
+	tasks       map[*task]semaphore
+	registries  map[string]semaphore
+	// set when several periodic tasks may be active at the same time
+	concurrentTasks bool
+}
+
+//
+func newLimits(conf *syncConfig) *limits {
+
+	ret := &limits{
+		parallelism: conf.Parallelism,
+		global:      newSemaphore(conf.Parallelism),
+		tasks:       make(map[*task]semaphore),
+		registries:  make(map[string]semaphore),
+	}
+
+	// when several locations for the same registry set a limit, the lowest
+	// one wins
+	perRegistry := make(map[string]int)
+	periodic := 0
+	for _, t := range conf.Tasks {
+		if t.isPeriodic() {
+			periodic++
+		}
+		// without any parallelism, a task is still given a limiter when other
+		// tasks run concurrently, just to keep its log output grouped per tag
+		if t.Parallelism == 0 && conf.Parallelism == 0 {
+			ret.tasks[t] = newSemaphore(1)
+		} else {
+			ret.tasks[t] = newSemaphore(t.Parallelism)
+		}
+		locs := []*location{t.Source}
+		for _, trgt := range t.Targets {
+			locs = append(locs, &trgt.location)
+		}
+		for _, l := range locs {
+			if l.Parallelism <= 0 {
+				continue
+			}
+			if p, ok := perRegistry[l.Registry]; !ok || l.Parallelism < p {
+				perRegistry[l.Registry] = l.Parallelism
+			}
+		}
+	}
+
+	for reg, p := range perRegistry {
+		ret.registries[reg] = newSemaphore(p)
+	}
+	ret.concurrentTasks = periodic > 1 && conf.MaxActiveTasks != 1
+
+	return ret
+}
+
+// taskParallelism returns how many tags task t may sync concurrently when not
+// limited by anything else, or 0 if it syncs sequentially. Tags are only
+// synced concurrently when the global or task parallelism is set.
+func (l *limits) taskParallelism(t *task) int {
+	if l.parallelism > 0 &&
+		(t.Parallelism == 0 || l.parallelism < t.Parallelism) {
+		return l.parallelism
+	}
+	return t.Parallelism
+}
+
+// limiter returns the limiter for syncing tags of task t between registries,
+// or nil if t syncs sequentially, and no other task can be active meanwhile
+func (l *limits) limiter(t *task, registries []string) relays.Limiter {
+
+	if l.taskParallelism(t) == 0 && !l.concurrentTasks {
+		return nil
+	}
+
+	// semaphores are always acquired in the same order, so that concurrent
+	// syncs cannot deadlock
+	sems := []semaphore{l.global, l.tasks[t]}
+	seen := make(map[string]bool)
+	var regs []string
+	for _, reg := range registries {
+		if !seen[reg] {
+			seen[reg] = true
+			regs = append(regs, reg)
+		}
+	}
+	sort.Strings(regs)
+	for _, reg := range regs {
+		sems = append(sems, l.registries[reg])
+	}
+
+	return &limiter{sems: sems}
+}
+
+// limiter implements relays.Limiter on top of a chain of semaphores
+type limiter struct {
+	sems []semaphore
+}
+
+//
+func (l *limiter) Acquire() func() {
+	for _, s := range l.sems {
+		s.acquire()
+	}
+	return func() {
+		for ix := len(l.sems) - 1; ix >= 0; ix-- {
+			l.sems[ix].release()
+		}
+	}
+}
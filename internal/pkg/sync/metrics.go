@@ -0,0 +1,81 @@
+/*
+ *
+ */
+
+package sync
+
+import (
+	"github.com/yannh/dregsy/internal/pkg/metrics"
+	"github.com/yannh/dregsy/internal/pkg/relays"
+)
+
+//
+var (
+	tagsSynced = metrics.NewCounter("dregsy_tags_synced_total",
+		"Number of tags copied to a target.", "task", "mapping")
+	tagsSkipped = metrics.NewCounter("dregsy_tags_skipped_total",
+		"Number of tags not copied to a target, since already present "+
+			"or unchanged there.", "task", "mapping", "reason")
+	tagsFailed = metrics.NewCounter("dregsy_tags_failed_total",
+		"Number of tags that failed to sync to a target.", "task", "mapping")
+	tagDuration = metrics.NewHistogram("dregsy_tag_sync_duration_seconds",
+		"Time taken for copying a tag to a target.",
+		metrics.DurationBuckets, "task", "mapping")
+
+	taskRuns = metrics.NewCounter("dregsy_task_runs_total",
+		"Number of task runs, by result.", "task", "result")
+	taskDuration = metrics.NewHistogram("dregsy_task_duration_seconds",
+		"Duration of task runs.", metrics.DurationBuckets, "task")
+	taskLastSuccess = metrics.NewGauge(
+		"dregsy_task_last_success_timestamp_seconds",
+		"Time of the last task run without errors, as Unix timestamp.",
+		"task")
+
+	authRefreshes = metrics.NewCounter("dregsy_auth_refreshes_total",
+		"Number of registry credential refreshes, by result.",
+		"registry", "result")
+	relayInvocations = metrics.NewCounter("dregsy_relay_invocations_total",
+		"Number of relay syncs, i.e. one per task mapping run, by result.",
+		"relay", "result")
+)
+
+// result values for metrics labels
+const (
+	resultSuccess     = "success"
+	resultFailure     = "failure"
+	resultInterrupted = "interrupted"
+)
+
+//
+func result(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+	return resultSuccess
+}
+
+// tagMetrics records the results of syncing the tags of a task mapping;
+// it implements relays.Observer
+type tagMetrics struct {
+	task    string
+	mapping string
+}
+
+//
+func (m *tagMetrics) TagsFiltered(listed, selected []string) {
+}
+
+//
+func (m *tagMetrics) TagDone(tag string, trgt *relays.Target,
+	res relays.TagResult, stats *relays.TagStats, err error) {
+
+	switch res {
+	case relays.TagCopied:
+		tagsSynced.Inc(m.task, m.mapping)
+		tagDuration.Observe(stats.Duration.Seconds(), m.task, m.mapping)
+	case relays.TagExists, relays.TagUnchanged:
+		tagsSkipped.Inc(m.task, m.mapping, res.String())
+	case relays.TagFailed:
+		tagsFailed.Inc(m.task, m.mapping)
+	}
+}
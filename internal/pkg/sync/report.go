@@ -0,0 +1,460 @@
+/*
+ *
+ */
+
+package sync
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/relays"
+)
+
+// report formats
+const (
+	reportJSON  = "json"
+	reportJUnit = "junit"
+)
+
+// taskReport is the outcome of a task run, written as a report file after
+// the run when configured
+type taskReport struct {
+	Task  string    `json:"task"`
+	Start time.Time `json:"start"`
+	// in seconds
+	Duration float64 `json:"duration"`
+	// one of the result values for metrics labels
+	Result string `json:"result"`
+	// with a dry run, the tags reported as planned or pruned would be copied
+	// or pruned, respectively
+	DryRun bool `json:"dryRun"`
+	// errors not related to any mapping, e.g. when listing source
+	// repositories for expanding mappings fails
+	Errors   []string         `json:"errors,omitempty"`
+	Mappings []*mappingReport `json:"mappings"`
+	mutex    gosync.Mutex
+}
+
+// mappingReport is the outcome of syncing a mapping; it implements
+// relays.Observer for collecting the results per tag
+type mappingReport struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Result string `json:"result"`
+	// errors not related to any tag, e.g. when refreshing credentials fails
+	Errors []string `json:"errors,omitempty"`
+	// what was not synced due to stopping
+	Interrupted string `json:"interrupted,omitempty"`
+	// tags listed in the source, and those not selected for syncing
+	Listed      []string `json:"listed"`
+	FilteredOut []string `json:"filteredOut"`
+	// one entry per selected tag and target, plus one per pruned tag
+	Tags    []*tagReport `json:"tags"`
+	Copied  int          `json:"copied"`
+	Skipped int          `json:"skipped"`
+	Failed  int          `json:"failed"`
+	Planned int          `json:"planned"`
+	Pruned  int          `json:"pruned"`
+	mutex   gosync.Mutex
+}
+
+// tagReport is the outcome of syncing a tag to a target
+type tagReport struct {
+	Tag    string `json:"tag"`
+	Target string `json:"target"`
+	Result string `json:"result"`
+	// in seconds; only for copied tags, same as bytes, and only where known
+	Duration float64 `json:"duration,omitempty"`
+	Bytes    int64   `json:"bytes,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+//
+func newTaskReport(task string, start time.Time) *taskReport {
+	return &taskReport{Task: task, Start: start}
+}
+
+//
+func (r *taskReport) addMapping(m *mapping) *mappingReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ret := &mappingReport{
+		From:        m.From,
+		To:          m.To,
+		Listed:      []string{},
+		FilteredOut: []string{},
+		Tags:        []*tagReport{},
+	}
+	r.Mappings = append(r.Mappings, ret)
+	return ret
+}
+
+//
+func (r *taskReport) fail(err error) {
+	if err != nil {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+// finish sets the result of the task run, and of each of its mappings
+func (r *taskReport) finish(result string, d time.Duration) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Result = result
+	r.Duration = d.Seconds()
+
+	for _, m := range r.Mappings {
+		m.mutex.Lock()
+		switch {
+		case m.Interrupted != "":
+			m.Result = resultInterrupted
+		case len(m.Errors) > 0 || m.Failed > 0:
+			m.Result = resultFailure
+		default:
+			m.Result = resultSuccess
+		}
+		m.mutex.Unlock()
+	}
+}
+
+//
+func (m *mappingReport) fail(err error) {
+	if err != nil {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.Errors = append(m.Errors, err.Error())
+	}
+}
+
+//
+func (m *mappingReport) interrupt(details string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Interrupted = details
+}
+
+//
+func (m *mappingReport) TagsFiltered(listed, selected []string) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	isSelected := make(map[string]bool)
+	for _, tag := range selected {
+		isSelected[tag] = true
+	}
+
+	m.Listed = append([]string{}, listed...)
+	m.FilteredOut = []string{}
+	for _, tag := range listed {
+		if !isSelected[tag] {
+			m.FilteredOut = append(m.FilteredOut, tag)
+		}
+	}
+}
+
+//
+func (m *mappingReport) TagDone(tag string, trgt *relays.Target,
+	res relays.TagResult, stats *relays.TagStats, err error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tr := &tagReport{Tag: tag, Target: trgt.Ref, Result: res.String()}
+	if stats != nil {
+		tr.Duration = stats.Duration.Seconds()
+		tr.Bytes = stats.Bytes
+	}
+	if err != nil {
+		tr.Error = err.Error()
+	}
+	m.Tags = append(m.Tags, tr)
+
+	switch res {
+	case relays.TagCopied:
+		m.Copied++
+	case relays.TagExists, relays.TagUnchanged:
+		m.Skipped++
+	case relays.TagFailed:
+		m.Failed++
+	case relays.TagPlanned:
+		m.Planned++
+	case relays.TagPruned:
+		m.Pruned++
+	}
+}
+
+// printPlan logs the actions that were found to be necessary during a dry
+// run, for each mapping
+func (r *taskReport) printPlan(lg *log.Logger) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, e := range r.Errors {
+		lg.With(log.Fields{"error": e}).Warning("plan: task incomplete")
+	}
+
+	for _, m := range r.Mappings {
+
+		m.mutex.Lock()
+		mlg := lg.With(log.Fields{"mapping": m.From})
+
+		flg := mlg
+		if len(m.FilteredOut) > 0 {
+			flg = mlg.With(log.Fields{
+				"filtered": strings.Join(m.FilteredOut, ",")})
+		}
+		flg.Info("plan: %d tag(s) in source, %d filtered out",
+			len(m.Listed), len(m.FilteredOut))
+
+		for _, e := range m.Errors {
+			mlg.With(log.Fields{"error": e}).Warning(
+				"plan: mapping incomplete")
+		}
+		if m.Interrupted != "" {
+			mlg.Warning("plan: mapping incomplete, %s", m.Interrupted)
+		}
+
+		tags := append([]*tagReport{}, m.Tags...)
+		sort.SliceStable(tags, func(i, j int) bool {
+			return tags[i].Tag < tags[j].Tag
+		})
+		for _, t := range tags {
+			tlg := mlg.With(log.Fields{"tag": t.Tag, "target": t.Target})
+			switch t.Result {
+			case relays.TagPlanned.String():
+				tlg.Info("plan: copy tag")
+			case relays.TagExists.String():
+				tlg.Info("plan: skip tag, already present")
+			case relays.TagUnchanged.String():
+				tlg.Info("plan: skip tag, unchanged")
+			case relays.TagPruned.String():
+				tlg.Info("plan: prune tag")
+			default:
+				tlg.With(log.Fields{"error": t.Error}).Warning(
+					"plan: cannot determine action for tag")
+			}
+		}
+
+		mlg.Info("plan: %d tag(s) to copy, %d to skip, %d to prune",
+			m.Planned, m.Skipped, m.Pruned)
+		log.Println()
+		m.mutex.Unlock()
+	}
+}
+
+/* ----------------------------------------------------------------------------
+ * writing reports
+ */
+
+// characters not to be used in report file names
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// write writes rep to the configured path; when that's a directory, a new
+// file named after task and start time is created in it, otherwise the file
+// is replaced
+func (c *reportConfig) write(rep *taskReport) error {
+
+	rep.mutex.Lock()
+	defer rep.mutex.Unlock()
+
+	var data []byte
+	var err error
+	ext := reportJSON
+
+	switch c.Format {
+	case reportJUnit:
+		data, err = rep.junit()
+		ext = "xml"
+	default:
+		data, err = json.MarshalIndent(rep, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return fmt.Errorf("error rendering report for task '%s': %v",
+			rep.Task, err)
+	}
+
+	path := c.Path
+	if fi, err := os.Stat(path); (err == nil && fi.IsDir()) ||
+		strings.HasSuffix(path, string(os.PathSeparator)) {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("error creating report directory: %v", err)
+		}
+		path = filepath.Join(path, fmt.Sprintf("%s-%s.%s",
+			unsafeFileChars.ReplaceAllString(rep.Task, "_"),
+			rep.Start.UTC().Format("20060102T150405Z"), ext))
+	}
+
+	// written to a temporary file first, so that readers never see a partial
+	// report
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".dregsy-report-")
+	if err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing report: %v", err)
+	}
+	return nil
+}
+
+/* ----------------------------------------------------------------------------
+ * JUnit XML, with a test suite per mapping, and a test case per tag and
+ * target; tags that were skipped are marked as such, and errors not related
+ * to any tag show up as failed test cases of their own
+ */
+type junitSuites struct {
+	XMLName  xml.Name      `xml:"testsuites"`
+	Name     string        `xml:"name,attr"`
+	Tests    int           `xml:"tests,attr"`
+	Failures int           `xml:"failures,attr"`
+	Skipped  int           `xml:"skipped,attr"`
+	Time     string        `xml:"time,attr"`
+	Suites   []*junitSuite `xml:"testsuite"`
+}
+
+//
+type junitSuite struct {
+	Name      string       `xml:"name,attr"`
+	Tests     int          `xml:"tests,attr"`
+	Failures  int          `xml:"failures,attr"`
+	Skipped   int          `xml:"skipped,attr"`
+	Timestamp string       `xml:"timestamp,attr"`
+	Cases     []*junitCase `xml:"testcase"`
+}
+
+//
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Skipped   *junitMessage `xml:"skipped"`
+	Failure   *junitMessage `xml:"failure"`
+}
+
+//
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+//
+func (s *junitSuite) add(c *junitCase) {
+	s.Cases = append(s.Cases, c)
+	s.Tests++
+	if c.Failure != nil {
+		s.Failures++
+	}
+	if c.Skipped != nil {
+		s.Skipped++
+	}
+}
+
+// junit renders this report as JUnit XML; the caller needs to hold the lock
+func (r *taskReport) junit() ([]byte, error) {
+
+	timestamp := r.Start.UTC().Format("2006-01-02T15:04:05")
+	ret := &junitSuites{Name: r.Task, Time: junitTime(r.Duration)}
+
+	if len(r.Errors) > 0 {
+		s := &junitSuite{Name: r.Task, Timestamp: timestamp}
+		for _, e := range r.Errors {
+			s.add(&junitCase{
+				Name:      "task",
+				ClassName: r.Task,
+				Time:      junitTime(0),
+				Failure:   &junitMessage{Message: e, Text: e},
+			})
+		}
+		ret.Suites = append(ret.Suites, s)
+	}
+
+	for _, m := range r.Mappings {
+		m.mutex.Lock()
+		class := fmt.Sprintf("%s.%s", r.Task, m.From)
+		s := &junitSuite{
+			Name:      fmt.Sprintf("%s %s", r.Task, m.From),
+			Timestamp: timestamp,
+		}
+		for _, e := range m.Errors {
+			s.add(&junitCase{
+				Name:      "mapping",
+				ClassName: class,
+				Time:      junitTime(0),
+				Failure:   &junitMessage{Message: e, Text: e},
+			})
+		}
+		if m.Interrupted != "" {
+			s.add(&junitCase{
+				Name:      "mapping",
+				ClassName: class,
+				Time:      junitTime(0),
+				Skipped: &junitMessage{
+					Message: "interrupted: " + m.Interrupted},
+			})
+		}
+		for _, t := range m.Tags {
+			c := &junitCase{
+				Name:      fmt.Sprintf("%s -> %s", t.Tag, t.Target),
+				ClassName: class,
+				Time:      junitTime(t.Duration),
+			}
+			switch t.Result {
+			case relays.TagPruned.String():
+				c.Name = fmt.Sprintf("prune %s from %s", t.Tag, t.Target)
+			case relays.TagFailed.String():
+				c.Failure = &junitMessage{Message: t.Error, Text: t.Error}
+			case relays.TagExists.String(), relays.TagUnchanged.String():
+				c.Skipped = &junitMessage{Message: t.Result}
+			}
+			s.add(c)
+		}
+		m.mutex.Unlock()
+		ret.Suites = append(ret.Suites, s)
+	}
+
+	for _, s := range ret.Suites {
+		ret.Tests += s.Tests
+		ret.Failures += s.Failures
+		ret.Skipped += s.Skipped
+	}
+
+	data, err := xml.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+//
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
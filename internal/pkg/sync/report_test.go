@@ -0,0 +1,160 @@
+package sync
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yannh/dregsy/internal/pkg/relays"
+)
+
+func testReport() *taskReport {
+
+	start := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+	rep := newTaskReport("my/task", start)
+	trgt := &relays.Target{Ref: "target.acme.com/busybox"}
+
+	m := rep.addMapping(&mapping{From: "/busybox", To: "/busybox"})
+	m.TagsFiltered([]string{"1.35", "1.36", "latest"}, []string{"1.35", "1.36"})
+	m.TagDone("1.35", trgt, relays.TagExists, nil, nil)
+	m.TagDone("1.36", trgt, relays.TagCopied,
+		&relays.TagStats{Duration: 1500 * time.Millisecond, Bytes: 1024}, nil)
+
+	m = rep.addMapping(&mapping{From: "/alpine", To: "/alpine"})
+	m.fail(errors.New("auth failed"))
+
+	m = rep.addMapping(&mapping{From: "/debian", To: "/debian"})
+	m.TagsFiltered([]string{"11"}, []string{"11"})
+	m.TagDone("11", trgt, relays.TagFailed, nil, errors.New("boom"))
+
+	m = rep.addMapping(&mapping{From: "/ubuntu", To: "/ubuntu"})
+	m.interrupt("not started")
+
+	rep.finish(resultFailure, 2*time.Second)
+	return rep
+}
+
+func TestReportJSON(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dregsy-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &reportConfig{Path: dir}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.write(testReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(
+		filepath.Join(dir, "my_task-20261017T100000Z.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rep struct {
+		Task     string
+		Result   string
+		Duration float64
+		Mappings []struct {
+			From        string
+			Result      string
+			Errors      []string
+			Interrupted string
+			Listed      []string
+			FilteredOut []string
+			Copied      int
+			Skipped     int
+			Failed      int
+			Tags        []struct {
+				Tag      string
+				Result   string
+				Duration float64
+				Bytes    int64
+				Error    string
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &rep); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if rep.Task != "my/task" || rep.Result != resultFailure ||
+		rep.Duration != 2 || len(rep.Mappings) != 4 {
+		t.Fatalf("unexpected report: %s", data)
+	}
+
+	m := rep.Mappings[0]
+	if m.Result != resultSuccess || m.Copied != 1 || m.Skipped != 1 ||
+		len(m.Listed) != 3 || len(m.FilteredOut) != 1 ||
+		m.FilteredOut[0] != "latest" || len(m.Tags) != 2 ||
+		m.Tags[1].Bytes != 1024 || m.Tags[1].Duration != 1.5 {
+		t.Errorf("unexpected report for first mapping: %s", data)
+	}
+
+	for ix, res := range []string{
+		resultFailure, resultFailure, resultInterrupted} {
+		if rep.Mappings[ix+1].Result != res {
+			t.Errorf("expected %s for mapping '%s', got %s", res,
+				rep.Mappings[ix+1].From, rep.Mappings[ix+1].Result)
+		}
+	}
+	if rep.Mappings[2].Tags[0].Error != "boom" {
+		t.Errorf("expected tag error, got %s", data)
+	}
+}
+
+func TestReportJUnit(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dregsy-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "report.xml")
+	conf := &reportConfig{Format: reportJUnit, Path: path}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.write(testReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var suites junitSuites
+	if err := xml.Unmarshal(data, &suites); err != nil {
+		t.Fatalf("invalid XML: %v", err)
+	}
+	if suites.Tests != 5 || suites.Failures != 2 || suites.Skipped != 2 ||
+		len(suites.Suites) != 4 {
+		t.Errorf("unexpected report: %s", data)
+	}
+	c := suites.Suites[0].Cases[1]
+	if c.Name != "1.36 -> target.acme.com/busybox" || c.Time != "1.500" ||
+		c.Failure != nil || c.Skipped != nil {
+		t.Errorf("unexpected test case: %+v", c)
+	}
+}
+
+func TestReportConfig(t *testing.T) {
+	if err := (&reportConfig{Path: "r.json", Format: "yaml"}).validate(); err == nil {
+		t.Error("expected error for invalid format")
+	}
+	if err := (&reportConfig{Format: reportJSON}).validate(); err == nil {
+		t.Error("expected error for missing path")
+	}
+}
@@ -0,0 +1,66 @@
+/*
+ *
+ */
+
+package sync
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/metrics"
+)
+
+// time given to requests in progress when shutting down the server
+const serverShutdownTimeout = 5 * time.Second
+
+// server is the HTTP server exposing metrics, and health and readiness
+// endpoints
+type server struct {
+	http     *http.Server
+	listener net.Listener
+}
+
+// newServer creates a server listening on the address given in the server
+// section of conf; it starts serving with start
+func (s *sync) newServer(conf *syncConfig) (*server, error) {
+
+	l, err := net.Listen("tcp", conf.Server.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", statusHandler(s.checkHealth))
+	mux.Handle("/readyz", statusHandler(func() []string {
+		return s.checkReadiness(conf)
+	}))
+
+	return &server{
+		http:     &http.Server{Handler: mux},
+		listener: l,
+	}, nil
+}
+
+//
+func (srv *server) start() {
+	log.Info("serving metrics, health, and readiness at http://%s",
+		srv.listener.Addr())
+	go func() {
+		if err := srv.http.Serve(srv.listener); err != http.ErrServerClosed {
+			log.Error(err)
+		}
+	}()
+}
+
+//
+func (srv *server) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		serverShutdownTimeout)
+	defer cancel()
+	log.Error(srv.http.Shutdown(ctx))
+}
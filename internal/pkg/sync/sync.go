@@ -5,94 +5,202 @@
 package sync
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"strings"
+	gosync "sync"
 	"syscall"
 	"time"
 
 	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/relays"
+	"github.com/yannh/dregsy/internal/pkg/relays/docker"
+	"github.com/yannh/dregsy/internal/pkg/relays/registry"
 	"github.com/yannh/dregsy/internal/pkg/relays/skopeo"
 )
 
-//
-type Relay interface {
-	Prepare() error
-	Dispose()
-	Sync(srcRef, srcAuth string, srcSkiptTLSVerify bool,
-		trgtRef, trgtAuth string, trgtSkiptTLSVerify bool,
-		tags []string, excludeTags []string, skipExistingTags bool, verbose bool) error
-}
-
 //
 type sync struct {
-	relay Relay
+	relays    map[string]relays.Relay
+	certsDirs map[string]string
+	limits    *limits
+	active    semaphore
+	// closed once dregsy is asked to stop; no further syncs are started then
+	stopping chan struct{}
+	// cancelled for aborting syncs in progress
+	ctx   context.Context
+	abort context.CancelFunc
+	// what was not synced because of stopping
+	interrupted []string
+	// set once all relays are prepared
+	prepared bool
+	// for checking that the schedulers are responsive, per task
+	probes map[string]chan chan struct{}
+	// where to write task run reports to, if at all
+	report *reportConfig
+	// when set, tasks are run once, without changing anything in the
+	// targets, and the planned actions are printed
+	dryRun bool
+	mutex  gosync.Mutex
 }
 
 //
 func New(conf *syncConfig) (*sync, error) {
-	sync := &sync{}
+
+	sync := &sync{
+		relays:    make(map[string]relays.Relay),
+		certsDirs: make(map[string]string),
+		limits:    newLimits(conf),
+		active:    newSemaphore(conf.MaxActiveTasks),
+		stopping:  make(chan struct{}),
+		report:    conf.Report,
+	}
+	sync.ctx, sync.abort = context.WithCancel(context.Background())
 
 	var out io.Writer = sync
 	if log.ToTerminal {
 		out = nil
 	}
 
-	sync.relay = skopeo.NewSkopeoRelay(conf.Skopeo, out)
+	for _, id := range conf.relays() {
+		relay, err := newRelay(id, conf, out)
+		if err != nil {
+			sync.Dispose()
+			return nil, err
+		}
+		sync.relays[id] = relay
+	}
+
+	// certs for listing source repositories are looked up the same way as
+	// done by the relay
+	sync.certsDirs[skopeo.RelayID] = skopeo.CertsBaseDir()
+	if conf.Registry != nil {
+		sync.certsDirs[registry.RelayID] = conf.Registry.CertsDir
+	}
+
 	return sync, nil
 }
 
 //
-func (s *sync) Dispose() {
-	s.relay.Dispose()
+func newRelay(id string, conf *syncConfig, out io.Writer) (relays.Relay, error) {
+
+	switch id {
+
+	case docker.RelayID:
+		return docker.NewDockerRelay(conf.Docker, out)
+
+	case skopeo.RelayID:
+		return skopeo.NewSkopeoRelay(conf.Skopeo, out), nil
+
+	case registry.RelayID:
+		return registry.NewRegistryRelay(conf.Registry), nil
+	}
+
+	return nil, fmt.Errorf("relay type '%s' not supported", id)
 }
 
 //
+func (s *sync) Dispose() {
+	for _, r := range s.relays {
+		r.Dispose()
+	}
+	s.abort()
+}
+
+// SetDryRun switches dry run mode on or off. In dry run mode, each task is
+// run once, regardless of its schedule. Tags are listed and filtered as usual,
+// but nothing gets synced or pruned, and no target repositories are created.
+// Instead, the planned actions are printed for each task.
+func (s *sync) SetDryRun(dryRun bool) {
+	s.dryRun = dryRun
+}
+
+// SyncFromConfig runs all tasks in conf; one-off tasks are run right away,
+// periodic tasks are scheduled, and run until dregsy is asked to stop
 func (s *sync) SyncFromConfig(conf *syncConfig) error {
+	return s.run(conf, conf.Tasks, s.dryRun)
+}
+
+// RunTask runs the task with name in conf just once, regardless of its
+// schedule
+func (s *sync) RunTask(conf *syncConfig, name string) error {
+	t := conf.task(name)
+	if t == nil {
+		return fmt.Errorf("no task '%s' in config", name)
+	}
+	return s.run(conf, []*task{t}, true)
+}
+
+// run runs tasks; with once set, all of them are run right away, one after
+// the other, and the server is not started
+func (s *sync) run(conf *syncConfig, tasks []*task, once bool) error {
 
-	if err := s.relay.Prepare(); err != nil {
+	if conf.Server != nil && !once {
+		srv, err := s.newServer(conf)
+		if err != nil {
+			return fmt.Errorf("cannot start server: %v", err)
+		}
+		srv.start()
+		defer srv.stop()
+	}
+
+	if err := s.prepare(tasks); err != nil {
 		return err
 	}
-	log.Println()
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	finished := make(chan struct{})
+	defer close(finished)
+	go s.handleSignals(sigs, *conf.GracePeriod, finished)
 
 	// one-off tasks
-	for _, t := range conf.Tasks {
-		if t.Interval == 0 {
+	for _, t := range tasks {
+		if !t.isPeriodic() || once {
+			if s.isStopping() {
+				s.interrupt("task '%s' not started", t.Name)
+				continue
+			}
 			s.syncTask(t)
 		}
 	}
 
-	// periodic tasks
-	c := make(chan *task)
-	ticking := false
+	// periodic tasks, each with its own scheduler
+	var schedulers gosync.WaitGroup
 
-	for _, t := range conf.Tasks {
-		if t.Interval > 0 {
-			t.startTicking(c)
-			ticking = true
+	periodic := false
+	for _, t := range tasks {
+		if t.isPeriodic() && !once {
+			periodic = true
+			schedulers.Add(1)
+			go func(t *task) {
+				defer schedulers.Done()
+				s.schedule(t, s.stopping)
+			}(t)
 		}
 	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-
-	for ticking {
-		log.Info("waiting for next sync task...")
-		log.Println()
-		select {
-		case t := <-c:
-			s.syncTask(t)
-		case sig := <-sigs:
-			log.Info("\nreceived '%v' signal, stopping ...\n", sig)
-			ticking = false
-		}
+	if periodic {
+		<-s.stopping
+		schedulers.Wait()
 	}
 
 	errs := false
-	for _, t := range conf.Tasks {
-		t.stopTicking(c)
-		errs = errs || t.failed
+	for _, t := range tasks {
+		errs = errs || t.hasFailed()
+	}
+
+	if len(s.interrupted) > 0 {
+		log.Warning("sync was interrupted:")
+		for _, i := range s.interrupted {
+			log.Warning("  %s", i)
+		}
+		return errors.New("sync interrupted, please see log for details")
 	}
 
 	if errs {
@@ -104,36 +212,400 @@ func (s *sync) SyncFromConfig(conf *syncConfig) error {
 	return nil
 }
 
+// prepare prepares the relays used by tasks
+func (s *sync) prepare(tasks []*task) error {
+	for _, id := range taskRelays(tasks) {
+		if err := s.relays[id].Prepare(); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	s.prepared = true
+	s.mutex.Unlock()
+	log.Println()
+	return nil
+}
+
+// ListTags returns the references of the source images, i.e. repository and
+// tag, that would be synced for the mapping with source path from, of the
+// task with name in conf. When the mapping is a regular expression or a glob,
+// the tags of all matching source repositories are returned. Nothing is
+// checked in or synced to the targets.
+func (s *sync) ListTags(conf *syncConfig, name, from string) (
+	[]string, error) {
+
+	t := conf.task(name)
+	if t == nil {
+		return nil, fmt.Errorf("no task '%s' in config", name)
+	}
+
+	var selected []*mapping
+	for _, m := range t.Mappings {
+		if m.From == from || m.From == normalizePath(from) {
+			selected = append(selected, m)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no mapping '%s' in task '%s'", from, name)
+	}
+
+	if err := s.prepare([]*task{t}); err != nil {
+		return nil, err
+	}
+
+	// only the selected mappings get expanded
+	lg := log.With(log.Fields{"task": t.Name})
+	expanded, err := (&task{Source: t.Source, Mappings: selected}).
+		expandMappings(s.ctx, lg, s.certsDirs[t.Relay])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.Source.refreshAuth(); err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, m := range expanded {
+
+		mlg := lg.With(log.Fields{"mapping": m.From})
+		filter := &tagFilter{}
+		// a dry run without targets only lists and filters the source tags
+		opt := t.syncOptions(m, mlg)
+		opt.DryRun = true
+		opt.Observer = filter
+
+		if err := s.relays[t.Relay].Sync(s.ctx, opt); err != nil {
+			return nil, err
+		}
+
+		mlg.Info("%d of %d tag(s) in source match", len(filter.selected),
+			len(filter.listed))
+		for _, tag := range filter.selected {
+			ret = append(ret, fmt.Sprintf("%s:%s", opt.SrcRef, tag))
+		}
+	}
+
+	return ret, nil
+}
+
+// tagFilter records the outcome of filtering the source tags during a sync;
+// it implements relays.Observer
+type tagFilter struct {
+	listed   []string
+	selected []string
+}
+
 //
-func (s *sync) syncTask(t *task) {
+func (f *tagFilter) TagsFiltered(listed, selected []string) {
+	f.listed = listed
+	f.selected = selected
+}
+
+//
+func (f *tagFilter) TagDone(tag string, trgt *relays.Target,
+	res relays.TagResult, stats *relays.TagStats, err error) {
+}
 
-	if t.tooSoon() {
-		log.Info("task '%s' fired too soon, skipping", t.Name)
+// handleSignals waits for a signal to stop, upon which no further syncs are
+// started. Syncs in progress get the grace period for finishing their current
+// tags, and are aborted once it's over, or when another signal arrives.
+// handleSignals returns early when finished gets closed.
+func (s *sync) handleSignals(sigs <-chan os.Signal, grace time.Duration,
+	finished <-chan struct{}) {
+
+	select {
+	case sig := <-sigs:
+		log.Println()
+		log.With(log.Fields{"signal": sig}).Info("received signal, stopping")
+		close(s.stopping)
+	case <-finished:
 		return
 	}
 
-	log.Info("syncing task '%s': '%s' --> '%s'",
-		t.Name, t.Source.Registry, t.Target.Registry)
+	if grace > 0 {
+		log.Info("waiting up to %s for syncs in progress, signal again to "+
+			"abort right away", grace)
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		if grace > 0 {
+			log.Warning("grace period is over, aborting syncs in progress")
+		}
+	case sig := <-sigs:
+		log.With(log.Fields{"signal": sig}).Warning(
+			"received signal again, aborting syncs in progress")
+	case <-finished:
+		return
+	}
+
+	s.abort()
+}
+
+//
+func (s *sync) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// interrupt records something that was not synced because of stopping, for
+// reporting at the end
+func (s *sync) interrupt(msg string, params ...interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.interrupted = append(s.interrupted, fmt.Sprintf(msg, params...))
+}
+
+// syncMapping syncs mapping m of task t with opt, and returns true if there
+// were errors; what didn't get synced due to stopping is recorded instead.
+// The outcome is also recorded in rep.
+func (s *sync) syncMapping(t *task, m *mapping, opt *relays.SyncOptions,
+	rep *mappingReport) bool {
+
+	err := s.relays[t.Relay].Sync(s.ctx, opt)
+
+	if intr, ok := err.(*relays.Interrupted); ok {
+		var details []string
+		if len(intr.Aborted) > 0 {
+			details = append(details, fmt.Sprintf("aborted tags '%s'",
+				strings.Join(intr.Aborted, "', '")))
+		}
+		if len(intr.Skipped) > 0 {
+			details = append(details, fmt.Sprintf("tags not started '%s'",
+				strings.Join(intr.Skipped, "', '")))
+		}
+		s.interrupt("task '%s', mapping '%s': %s", t.Name, m.From,
+			strings.Join(details, ", "))
+		rep.interrupt(strings.Join(details, ", "))
+		relayInvocations.Inc(t.Relay, resultInterrupted)
+		return intr.Failed
+	}
+
+	// anything failing after aborting is most likely due to that
+	if err != nil && s.ctx.Err() != nil {
+		s.interrupt("task '%s', mapping '%s': aborted (%v)", t.Name, m.From,
+			err)
+		rep.interrupt(fmt.Sprintf("aborted (%v)", err))
+		relayInvocations.Inc(t.Relay, resultInterrupted)
+		return false
+	}
+
+	relayInvocations.Inc(t.Relay, result(err))
+	rep.fail(err)
+	return opt.Log.Error(err)
+}
+
+// schedule runs periodic task t at its interval or schedule, until stop gets
+// closed. A run that is due while the previous one is still going on is
+// skipped. Once stopped, schedule waits for an ongoing run to finish.
+func (s *sync) schedule(t *task, stop <-chan struct{}) {
+
+	var runs gosync.WaitGroup
+	defer runs.Wait()
+
+	lg := log.With(log.Fields{"task": t.Name})
+	probe := make(chan chan struct{})
+	s.addProbe(t.Name, probe)
+	defer s.removeProbe(t.Name)
+
+	run := func() {
+		if !t.tryStart() {
+			lg.Info("task still running, skipping this run")
+			return
+		}
+		runs.Add(1)
+		go func() {
+			defer runs.Done()
+			defer t.done()
+			if !s.active.tryAcquire() {
+				lg.Info("task waiting for other tasks to finish")
+				s.active.acquire()
+			}
+			defer s.active.release()
+			s.syncTask(t)
+		}()
+	}
+
+	due := time.Now()
+	if t.runOnStart() {
+		run()
+	}
+
+	for {
+		due = t.nextRun(due)
+		at := due.Add(t.jitter())
+		lg.Info("next run of task at %s", at.Format(time.RFC3339))
+		log.Println()
+		timer := time.NewTimer(time.Until(at))
+		for fired := false; !fired; {
+			select {
+			case <-timer.C:
+				run()
+				fired = true
+			case reply := <-probe:
+				close(reply)
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
+
+//
+func (s *sync) syncTask(t *task) {
+
+	lg := log.With(log.Fields{"task": t.Name})
+	lg.With(log.Fields{
+		"source": t.Source.Registry,
+		"target": strings.Join(t.targetRegistries(), ","),
+	}).Info("syncing task")
+	start := time.Now()
+	t.mutex.Lock()
 	t.failed = false
+	t.mutex.Unlock()
 
-	for _, m := range t.Mappings {
-		log.Info("mapping '%s' to '%s'", m.From, m.To)
-		src, trgt := t.mappingRefs(m)
-		t.fail(log.Error(t.Source.refreshAuth()))
-		t.fail(log.Error(t.Target.refreshAuth()))
-		t.fail(log.Error(t.ensureTargetExists(trgt)))
-		t.fail(log.Error(s.relay.Sync(
-			src, t.Source.Auth, t.Source.SkipTLSVerify,
-			trgt, t.Target.Auth, t.Target.SkipTLSVerify,
-			m.Tags, m.ExcludeTags, t.SkipExistingTags, t.Verbose)))
-	}
-
-	t.lastTick = time.Now()
+	rep := newTaskReport(t.Name, start)
+	rep.DryRun = s.dryRun
+	mappings, err := t.expandMappings(s.ctx, lg, s.certsDirs[t.Relay])
+	t.fail(lg.Error(err))
+	rep.fail(err)
+
+	// with parallelism, as many mappings as tags may be synced concurrently;
+	// the limits on tags are still enforced by the limiter
+	slots := newSemaphore(s.limits.taskParallelism(t))
+	var wg gosync.WaitGroup
+
+	for _, m := range mappings {
+		mrep := rep.addMapping(m)
+		if s.isStopping() {
+			s.interrupt("task '%s', mapping '%s': not started", t.Name, m.From)
+			mrep.interrupt("not started")
+			continue
+		}
+		mlg := lg.With(log.Fields{"mapping": m.From})
+		mlg.With(log.Fields{"to": m.To}).Info("syncing mapping")
+		_, trgts := t.mappingRefs(m)
+		prune, protect := t.prune(m)
+		err := t.Source.refreshAuth()
+		t.fail(mlg.Error(err))
+		mrep.fail(err)
+
+		registries := []string{t.Source.Registry}
+		var targets []*relays.Target
+		for ix, trgt := range t.Targets {
+			err := trgt.refreshAuth()
+			if err == nil && !s.dryRun {
+				err = t.ensureTargetExists(mlg, trgt, trgts[ix])
+			}
+			if mlg.Error(err) {
+				mrep.fail(err)
+				t.fail(true)
+				continue
+			}
+			targets = append(targets, &relays.Target{
+				Ref:           trgts[ix],
+				Auth:          trgt.Auth,
+				SkipTLSVerify: trgt.SkipTLSVerify,
+			})
+			registries = append(registries, trgt.Registry)
+		}
+		if len(targets) == 0 {
+			continue
+		}
+
+		// results go to metrics, and to the report
+		observer := relays.Observers{
+			&tagMetrics{task: t.Name, mapping: m.From}, mrep}
+
+		opt := t.syncOptions(m, mlg)
+		opt.Targets = targets
+		opt.SkipExistingTags = t.SkipExistingTags
+		opt.SkipUnchangedTags = t.SkipUnchangedTags
+		opt.Prune = prune
+		opt.PruneProtect = protect
+		opt.PruneDryRun = t.PruneDryRun
+		opt.DryRun = s.dryRun
+		opt.Limiter = s.limits.limiter(t, registries)
+		opt.Stop = s.stopping
+		opt.Observer = observer
+
+		if slots == nil {
+			t.fail(s.syncMapping(t, m, opt, mrep))
+			continue
+		}
+
+		slots.acquire()
+		wg.Add(1)
+		go func(m *mapping, mrep *mappingReport) {
+			defer wg.Done()
+			defer slots.release()
+			t.fail(s.syncMapping(t, m, opt, mrep))
+		}(m, mrep)
+	}
+
+	wg.Wait()
+	d := time.Since(start)
+	lg.With(log.Fields{"duration": d.Round(time.Millisecond)}).Info(
+		"task done")
 	log.Println()
+
+	taskDuration.Observe(d.Seconds(), t.Name)
+	res := resultSuccess
+	switch {
+	case t.hasFailed():
+		res = resultFailure
+		t.countRun()
+	case s.isStopping():
+		res = resultInterrupted
+	default:
+		taskLastSuccess.Set(float64(time.Now().Unix()), t.Name)
+		t.countRun()
+	}
+	taskRuns.Inc(t.Name, res)
+
+	if s.report != nil || s.dryRun {
+		rep.finish(res, d)
+	}
+	if s.dryRun {
+		rep.printPlan(lg)
+	}
+	if s.report != nil {
+		lg.Error(s.report.write(rep))
+	}
 }
 
-//
+// syncOptions returns the options for syncing mapping m of this task, with
+// the source and tag filters set up, but without any targets
+func (t *task) syncOptions(m *mapping, lg *log.Logger) *relays.SyncOptions {
+	src, _ := t.mappingRefs(m)
+	return &relays.SyncOptions{
+		SrcRef:           src,
+		SrcAuth:          t.Source.Auth,
+		SrcSkipTLSVerify: t.Source.SkipTLSVerify,
+		Tags:             m.Tags,
+		ExcludeTags:      m.ExcludeTags,
+		Latest:           m.Latest,
+		SortBy:           m.SortBy,
+		MinAge:           time.Duration(m.MinAge),
+		MaxAge:           time.Duration(m.MaxAge),
+		Platforms:        m.Platforms,
+		Verbose:          t.Verbose,
+		Retry:            t.Retry.policy(),
+		Log:              lg,
+	}
+}
+
+// Write passes output of the relays on to the log, so that with JSON output,
+// it also turns into messages
 func (s *sync) Write(p []byte) (n int, err error) {
-	fmt.Print(string(p))
-	return len(p), nil
+	return log.With(nil).Write(p)
 }
@@ -0,0 +1,456 @@
+package sync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/yannh/dregsy/internal/pkg/log"
+	"github.com/yannh/dregsy/internal/pkg/relays"
+	"github.com/yannh/dregsy/internal/pkg/relays/skopeo"
+)
+
+// fakeRelay records the syncs it is asked to do, and blocks each of them
+// until released
+type fakeRelay struct {
+	mutex   gosync.Mutex
+	started chan string
+	release chan struct{}
+	active  int
+	max     int
+	// if set, returned right away from every sync
+	interrupt *relays.Interrupted
+}
+
+func newFakeRelay() *fakeRelay {
+	return &fakeRelay{
+		started: make(chan string, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (r *fakeRelay) Prepare() error {
+	return nil
+}
+
+func (r *fakeRelay) Dispose() {
+}
+
+func (r *fakeRelay) Sync(ctx context.Context, opt *relays.SyncOptions) error {
+	if r.interrupt != nil {
+		return r.interrupt
+	}
+	r.mutex.Lock()
+	r.active++
+	if r.active > r.max {
+		r.max = r.active
+	}
+	r.mutex.Unlock()
+	r.started <- opt.SrcRef
+	<-r.release
+	r.mutex.Lock()
+	r.active--
+	r.mutex.Unlock()
+	return nil
+}
+
+func periodicTask(name string) *task {
+	return &task{
+		Name:     name,
+		Relay:    "registry",
+		Interval: 60,
+		Source:   &location{Registry: "source.acme.com"},
+		Targets:  []*target{{location: location{Registry: "target.acme.com"}}},
+		Mappings: []*mapping{{From: "/" + name}},
+	}
+}
+
+func TestSchedule(t *testing.T) {
+
+	conf := &syncConfig{
+		MaxActiveTasks: 1,
+		Tasks:          []*task{periodicTask("t1"), periodicTask("t2")},
+	}
+	relay := newFakeRelay()
+	s := &sync{
+		relays:    map[string]relays.Relay{"registry": relay},
+		certsDirs: make(map[string]string),
+		limits:    newLimits(conf),
+		active:    newSemaphore(conf.MaxActiveTasks),
+		stopping:  make(chan struct{}),
+		ctx:       context.Background(),
+	}
+
+	stop := make(chan struct{})
+	var schedulers gosync.WaitGroup
+	for _, tk := range conf.Tasks {
+		schedulers.Add(1)
+		go func(tk *task) {
+			defer schedulers.Done()
+			s.schedule(tk, stop)
+		}(tk)
+	}
+
+	// both tasks are due right away, but only one may be active at a time
+	first := <-relay.started
+	select {
+	case ref := <-relay.started:
+		t.Fatalf("sync of '%s' started while '%s' still active", ref, first)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a running task is not started again
+	for _, tk := range conf.Tasks {
+		if "source.acme.com/"+tk.Name == first && tk.tryStart() {
+			t.Errorf("task '%s' should be marked as running", tk.Name)
+		}
+	}
+
+	relay.release <- struct{}{}
+	second := <-relay.started
+	if second == first {
+		t.Errorf("expected other task to run, got '%s' again", second)
+	}
+
+	// stopping waits for the ongoing run
+	close(stop)
+	done := make(chan struct{})
+	go func() {
+		schedulers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("schedulers stopped before run finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	relay.release <- struct{}{}
+	<-done
+
+	if relay.max != 1 {
+		t.Errorf("expected one active task at most, got %d", relay.max)
+	}
+	for _, tk := range conf.Tasks {
+		if tk.running {
+			t.Errorf("task '%s' still marked as running", tk.Name)
+		}
+	}
+}
+
+func TestStopping(t *testing.T) {
+
+	tk := periodicTask("t1")
+	tk.Mappings = append(tk.Mappings, &mapping{From: "/t2"})
+	relay := newFakeRelay()
+	relay.interrupt = &relays.Interrupted{
+		Aborted: []string{"v1"}, Skipped: []string{"v2", "v3"}}
+	s := &sync{
+		relays:    map[string]relays.Relay{"registry": relay},
+		certsDirs: make(map[string]string),
+		limits:    newLimits(&syncConfig{}),
+		stopping:  make(chan struct{}),
+		ctx:       context.Background(),
+	}
+
+	// interrupted syncs are reported, but are not errors
+	s.syncTask(tk)
+	if tk.hasFailed() {
+		t.Error("interrupted task should not be marked as failed")
+	}
+	if len(s.interrupted) != 2 || s.interrupted[0] != "task 't1', "+
+		"mapping '/t1': aborted tags 'v1', tags not started 'v2', 'v3'" {
+		t.Errorf("unexpected report: %q", s.interrupted)
+	}
+
+	// once stopping, no mappings are synced
+	s.interrupted = nil
+	relay.interrupt = nil
+	close(s.stopping)
+	s.syncTask(tk)
+	if len(s.interrupted) != 2 ||
+		s.interrupted[1] != "task 't1', mapping '/t2': not started" {
+		t.Errorf("unexpected report: %q", s.interrupted)
+	}
+	select {
+	case ref := <-relay.started:
+		t.Errorf("sync of '%s' started while stopping", ref)
+	default:
+	}
+}
+
+// listingRelay lists a fixed set of tags for every source, and filters them
+// as a relay would
+type listingRelay struct {
+	tags []string
+}
+
+func (r *listingRelay) Prepare() error {
+	return nil
+}
+
+func (r *listingRelay) Dispose() {
+}
+
+func (r *listingRelay) Sync(ctx context.Context,
+	opt *relays.SyncOptions) error {
+	if len(opt.Targets) > 0 || !opt.DryRun {
+		return errors.New("unexpected sync")
+	}
+	_, err := opt.FilterTags(r.tags, nil)
+	return err
+}
+
+func TestListTags(t *testing.T) {
+
+	tk := periodicTask("t1")
+	tk.Mappings = []*mapping{
+		{From: "/busybox", Tags: []string{"1.*"}, ExcludeTags: []string{"1.0"}},
+		{From: "/alpine"},
+	}
+	conf := &syncConfig{Tasks: []*task{tk}}
+	s := &sync{
+		relays: map[string]relays.Relay{
+			"registry": &listingRelay{
+				tags: []string{"1.0", "1.1", "1.2", "latest"}},
+		},
+		certsDirs: make(map[string]string),
+		ctx:       context.Background(),
+	}
+
+	refs, err := s.ListTags(conf, "t1", "busybox")
+	if err != nil {
+		t.Fatalf("error listing tags: %v", err)
+	}
+	expected := []string{
+		"source.acme.com/busybox:1.1", "source.acme.com/busybox:1.2"}
+	if strings.Join(refs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, refs)
+	}
+
+	if _, err := s.ListTags(conf, "t2", "/busybox"); err == nil {
+		t.Error("expected error for unknown task")
+	}
+	if _, err := s.ListTags(conf, "t1", "/debian"); err == nil {
+		t.Error("expected error for unknown mapping")
+	}
+}
+
+func TestRunTask(t *testing.T) {
+
+	conf := &syncConfig{
+		GracePeriod: new(time.Duration),
+		Tasks:       []*task{periodicTask("t1"), periodicTask("t2")},
+	}
+	relay := newFakeRelay()
+	s := &sync{
+		relays:    map[string]relays.Relay{"registry": relay},
+		certsDirs: make(map[string]string),
+		limits:    newLimits(conf),
+		stopping:  make(chan struct{}),
+		ctx:       context.Background(),
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.RunTask(conf, "t2")
+	}()
+
+	// the task is run once, and then RunTask returns
+	if ref := <-relay.started; ref != "source.acme.com/t2" {
+		t.Errorf("unexpected sync of '%s'", ref)
+	}
+	relay.release <- struct{}{}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("task not run just once")
+	}
+
+	if err := s.RunTask(conf, "t3"); err == nil {
+		t.Error("expected error for unknown task")
+	}
+}
+
+func TestRelayOutputJSON(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dregsy-skopeo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a skopeo stand-in writing raw output to stdout and stderr
+	binary := filepath.Join(dir, "skopeo")
+	if err := ioutil.WriteFile(binary, []byte(`#!/bin/sh
+echo "Getting image source signatures"
+echo "Copying blob sha256:0123456789abcdef" >&2
+echo "Writing manifest to image destination"
+`), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(tt bool) {
+		log.SetFormat(log.FormatText)
+		log.ToTerminal = tt
+	}(log.ToTerminal)
+	log.SetFormat(log.FormatJSON)
+
+	conf := &syncConfig{
+		Relay:  skopeo.RelayID,
+		Skopeo: &skopeo.RelayConfig{Binary: binary},
+		Tasks: []*task{{
+			Name:     "t1",
+			Verbose:  true,
+			Source:   &location{Registry: "source.acme.com"},
+			Targets:  []*target{{location: location{Registry: "target.acme.com"}}},
+			Mappings: []*mapping{{From: "/busybox", Tags: []string{"1.36"}}},
+		}},
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// capture everything written to stdout and stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+	}()
+
+	lines := make(chan []string)
+	go func() {
+		var ret []string
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			ret = append(ret, scanner.Text())
+		}
+		lines <- ret
+	}()
+
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.RunTask(conf, "t1")
+	s.Dispose()
+	os.Stdout, os.Stderr = stdout, stderr
+	w.Close()
+	out := <-lines
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	found := false
+	for _, line := range out {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Errorf("not a JSON object: %q", line)
+			continue
+		}
+		if m["msg"] == "Copying blob sha256:0123456789abcdef" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("relay output missing from log:\n%s", strings.Join(out, "\n"))
+	}
+}
+
+// get returns status code and body of the response to a GET of path
+func get(t *testing.T, srv *server, path string) (int, string) {
+	resp, err := http.Get("http://" + srv.listener.Addr().String() + path)
+	if err != nil {
+		t.Fatalf("error getting '%s': %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading '%s': %v", path, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestServer(t *testing.T) {
+
+	tagsSynced.Inc("test-task", "/test/image")
+
+	tk := periodicTask("t1")
+	conf := &syncConfig{
+		Server: &serverConfig{Listen: "127.0.0.1:0", ToleratedFailures: 1},
+		Tasks:  []*task{tk},
+	}
+	s := &sync{stopping: make(chan struct{})}
+	srv, err := s.newServer(conf)
+	if err != nil {
+		t.Fatalf("error creating server: %v", err)
+	}
+	srv.start()
+	defer srv.stop()
+
+	_, body := get(t, srv, "/metrics")
+	expected := `dregsy_tags_synced_total{task="test-task",mapping="/test/image"}`
+	if !strings.Contains(body, expected) {
+		t.Errorf("expected metrics to contain '%s', got:\n%s", expected, body)
+	}
+
+	// health checks the scheduler
+	tk.RunOnStart = new(bool)
+	stop := make(chan struct{})
+	scheduled := make(chan struct{})
+	go func() {
+		defer close(scheduled)
+		s.schedule(tk, stop)
+	}()
+	for {
+		s.mutex.Lock()
+		n := len(s.probes)
+		s.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status, body := get(t, srv, "/healthz"); status != http.StatusOK {
+		t.Errorf("expected to be healthy, got %d: %s", status, body)
+	}
+	close(stop)
+	<-scheduled
+
+	// ready once prepared, and as long as failures are tolerated
+	if status, _ := get(t, srv, "/readyz"); status == http.StatusOK {
+		t.Error("should not be ready before relays are prepared")
+	}
+	s.prepared = true
+	if status, body := get(t, srv, "/readyz"); status != http.StatusOK {
+		t.Errorf("expected to be ready, got %d: %s", status, body)
+	}
+	tk.failed = true
+	tk.countRun()
+	if status, body := get(t, srv, "/readyz"); status != http.StatusOK {
+		t.Errorf("one failed run should be tolerated, got %d: %s",
+			status, body)
+	}
+	tk.countRun()
+	status, body := get(t, srv, "/readyz")
+	if status != http.StatusServiceUnavailable ||
+		!strings.Contains(body, "task 't1' failed in last 2 run(s)") {
+		t.Errorf("expected to not be ready, got %d: %s", status, body)
+	}
+}
@@ -0,0 +1,175 @@
+package tags
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// a semantic version with optional 'v' prefix; minor and patch may be omitted,
+// so that '1.2' and 'v2' are also accepted
+var semverRegexp = regexp.MustCompile(
+	`^v?(0|[1-9][0-9]*)(?:\.(0|[1-9][0-9]*))?(?:\.(0|[1-9][0-9]*))?` +
+		`(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+[0-9A-Za-z-.]+)?$`)
+
+// IsSemver returns true if v is a semantic version, with optional 'v' prefix
+// and optional minor and patch parts
+func IsSemver(v string) bool {
+	_, ok := parseVersion(v)
+	return ok
+}
+
+type version struct {
+	major, minor, patch uint64
+	pre                 []string
+	// number of version parts given, e.g. 2 for '1.2'
+	parts int
+}
+
+func parseVersion(v string) (*version, bool) {
+
+	m := semverRegexp.FindStringSubmatch(v)
+	if m == nil {
+		return nil, false
+	}
+
+	ret := &version{parts: 1}
+	var err error
+
+	if ret.major, err = strconv.ParseUint(m[1], 10, 64); err != nil {
+		return nil, false
+	}
+	if m[2] != "" {
+		ret.parts++
+		if ret.minor, err = strconv.ParseUint(m[2], 10, 64); err != nil {
+			return nil, false
+		}
+	}
+	if m[3] != "" {
+		ret.parts++
+		if ret.patch, err = strconv.ParseUint(m[3], 10, 64); err != nil {
+			return nil, false
+		}
+	}
+	if m[4] != "" {
+		ret.pre = strings.Split(m[4], ".")
+	}
+
+	return ret, true
+}
+
+// compare returns -1, 0, or 1 if v is lower, equal, or higher than o, as per
+// semantic versioning precedence rules
+func (v *version) compare(o *version) int {
+
+	if c := compareUint(v.major, o.major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.minor, o.minor); c != 0 {
+		return c
+	}
+	if c := compareUint(v.patch, o.patch); c != 0 {
+		return c
+	}
+
+	// a pre-release has lower precedence than the release
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+
+	for ix := 0; ix < len(v.pre) && ix < len(o.pre); ix++ {
+		if c := comparePreRelease(v.pre[ix], o.pre[ix]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(v.pre)), uint64(len(o.pre)))
+}
+
+// upperBound returns the exclusive upper bound for a tilde or caret range
+// starting at v, e.g. 1.5.0-0 for ~1.4 and 2.0.0-0 for ^1.4. The lowest
+// possible pre-release is used so that pre-releases of the bound itself are
+// excluded.
+func (v *version) upperBound(caret bool) *version {
+
+	ret := &version{pre: []string{"0"}, parts: 3}
+
+	switch {
+	case caret && v.major > 0, v.parts == 1:
+		ret.major = v.major + 1
+	case caret && v.minor > 0, v.parts == 2, !caret:
+		ret.major = v.major
+		ret.minor = v.minor + 1
+	default:
+		ret.major = v.major
+		ret.minor = v.minor
+		ret.patch = v.patch + 1
+	}
+
+	return ret
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// numeric identifiers have lower precedence than alphanumeric ones
+func comparePreRelease(a, b string) int {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		return compareUint(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareLexical returns true if tag satisfies the comparison with operator op
+// against operand, comparing them as strings
+func compareLexical(op, tag, operand string) bool {
+	c := strings.Compare(tag, operand)
+	switch op {
+	case "<=":
+		return c <= 0
+	case "<":
+		return c < 0
+	case ">=":
+		return c >= 0
+	case ">":
+		return c > 0
+	}
+	return false
+}
+
+// matches returns true if v satisfies the comparison with operator op
+// against operand
+func (v *version) matches(op string, operand *version) bool {
+	switch op {
+	case "<=":
+		return v.compare(operand) <= 0
+	case "<":
+		return v.compare(operand) < 0
+	case ">=":
+		return v.compare(operand) >= 0
+	case ">":
+		return v.compare(operand) > 0
+	case "~", "^":
+		return v.compare(operand) >= 0 &&
+			v.compare(operand.upperBound(op == "^")) < 0
+	}
+	return false
+}
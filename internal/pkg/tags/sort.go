@@ -0,0 +1,92 @@
+package tags
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// strategies for determining which tags are the newest
+const (
+	SortSemver  = "semver"
+	SortLexical = "lexical"
+	SortCreated = "created"
+)
+
+// CreatedFunc returns the creation time of the image with the given tag
+type CreatedFunc func(tag string) (time.Time, error)
+
+// ValidateSortBy checks whether sortBy is a known sort strategy; empty means
+// the default, SortSemver
+func ValidateSortBy(sortBy string) error {
+	switch sortBy {
+	case "", SortSemver, SortLexical, SortCreated:
+		return nil
+	}
+	return fmt.Errorf("invalid sort strategy '%s', must be one of '%s', "+
+		"'%s', or '%s'", sortBy, SortSemver, SortLexical, SortCreated)
+}
+
+// Latest returns the n newest tags, newest first. With SortSemver, tags that
+// are not semantic versions are considered older than all that are, and are
+// ordered lexically among themselves. With SortCreated, created is called for
+// each tag to get the creation time of its image.
+func Latest(tags []string, n int, sortBy string, created CreatedFunc) (
+	[]string, error) {
+
+	ret := make([]string, len(tags))
+	copy(ret, tags)
+
+	switch sortBy {
+
+	case "", SortSemver:
+		sort.SliceStable(ret, func(i, j int) bool {
+			return compareSemverFirst(ret[i], ret[j]) > 0
+		})
+
+	case SortLexical:
+		sort.SliceStable(ret, func(i, j int) bool {
+			return strings.Compare(ret[i], ret[j]) > 0
+		})
+
+	case SortCreated:
+		times := make(map[string]time.Time, len(ret))
+		for _, tag := range ret {
+			t, err := created(tag)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"cannot determine creation time of tag '%s': %v", tag, err)
+			}
+			times[tag] = t
+		}
+		sort.SliceStable(ret, func(i, j int) bool {
+			return times[ret[i]].After(times[ret[j]])
+		})
+
+	default:
+		return nil, ValidateSortBy(sortBy)
+	}
+
+	if n < len(ret) {
+		ret = ret[:n]
+	}
+	return ret, nil
+}
+
+// compareSemverFirst orders semantic versions above all other tags
+func compareSemverFirst(a, b string) int {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	switch {
+	case okA && okB:
+		if c := va.compare(vb); c != 0 {
+			return c
+		}
+	case okA:
+		return 1
+	case okB:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,71 @@
+package tags
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLatest(t *testing.T) {
+
+	tags := []string{"v1.9", "latest", "v1.10.0", "v1.10.0-rc.1", "v1.2"}
+	created := map[string]time.Time{
+		"v1.9":         time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+		"latest":       time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+		"v1.10.0":      time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+		"v1.10.0-rc.1": time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		"v1.2":         time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC),
+	}
+	createdFunc := func(tag string) (time.Time, error) {
+		if c, ok := created[tag]; ok {
+			return c, nil
+		}
+		return time.Time{}, fmt.Errorf("unknown tag %s", tag)
+	}
+
+	for _, testCase := range []struct {
+		n      int
+		sortBy string
+		expect []string
+	}{
+		{
+			n:      3,
+			sortBy: SortSemver,
+			expect: []string{"v1.10.0", "v1.10.0-rc.1", "v1.9"},
+		},
+		{
+			n:      10,
+			sortBy: "",
+			expect: []string{"v1.10.0", "v1.10.0-rc.1", "v1.9", "v1.2", "latest"},
+		},
+		{
+			n:      2,
+			sortBy: SortLexical,
+			expect: []string{"v1.9", "v1.2"},
+		},
+		{
+			n:      2,
+			sortBy: SortCreated,
+			expect: []string{"latest", "v1.2"},
+		},
+	} {
+		res, err := Latest(tags, testCase.n, testCase.sortBy, createdFunc)
+		if err != nil {
+			t.Errorf("sort by '%s' failed: %v", testCase.sortBy, err)
+		}
+		if !reflect.DeepEqual(res, testCase.expect) {
+			t.Errorf("sort by '%s' failed, expected %v, got %v",
+				testCase.sortBy, testCase.expect, res)
+		}
+	}
+
+	if _, err := Latest(append(tags, "unknown"), 1, SortCreated,
+		createdFunc); err == nil {
+		t.Error("sort by creation time should fail for unknown tag")
+	}
+
+	if _, err := Latest(tags, 1, "random", createdFunc); err == nil {
+		t.Error("invalid sort strategy should fail")
+	}
+}
@@ -4,8 +4,37 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 )
 
+// RegexPrefix marks a pattern as a regular expression, e.g.
+// 'regex:^v\d+\.\d+\.\d+(-alpine)?$'
+const RegexPrefix = "regex:"
+
+// compiled regular expressions, by pattern
+var regexps sync.Map
+
+// IsRegex returns true if pattern is a regular expression
+func IsRegex(pattern string) bool {
+	return strings.HasPrefix(pattern, RegexPrefix)
+}
+
+// CompileRegex compiles a regular expression pattern, i.e. one with
+// RegexPrefix. The result is cached, so calling this when loading the config
+// both validates the pattern, and saves compiling it again when matching.
+func CompileRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(strings.TrimPrefix(pattern, RegexPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression in %s: %v",
+			pattern, err)
+	}
+	regexps.Store(pattern, re)
+	return re, nil
+}
+
 func GetComparisonOperator(tag string) string {
 	if strings.HasPrefix(tag, "<=") {
 		return "<="
@@ -19,28 +48,72 @@ func GetComparisonOperator(tag string) string {
 	if strings.HasPrefix(tag, ">") {
 		return ">"
 	}
+	if strings.HasPrefix(tag, "~") {
+		return "~"
+	}
+	if strings.HasPrefix(tag, "^") {
+		return "^"
+	}
 
 	return ""
 }
 
+// IsRange returns true if pattern consists of several space separated
+// constraints, e.g. '>=1.2 <2.0', all of which a tag needs to satisfy
+func IsRange(pattern string) bool {
+	return !IsRegex(pattern) && len(strings.Fields(pattern)) > 1
+}
+
+// IsPattern returns true if tag is not a literal tag, but a wildcard pattern or
+// comparison against which concrete tags need to be matched.
+func IsPattern(tag string) bool {
+	return IsRegex(tag) || GetComparisonOperator(tag) != "" ||
+		strings.Contains(tag, "*") || IsRange(tag)
+}
+
 func patternToRegexp(pattern string) (*regexp.Regexp, error) {
 	pattern = regexp.QuoteMeta(pattern)
 	return regexp.Compile(strings.ReplaceAll(pattern, "\\*", "[0-9a-zA-Z-_]*"))
 }
 
 func matchPattern(tag, pattern string) (bool, error) {
-	switch op := GetComparisonOperator(pattern); op {
-	case "<=":
-		return strings.Compare(tag, pattern[2:]) <= 0, nil
 
-	case "<":
-		return strings.Compare(tag, pattern[1:]) < 0, nil
+	if IsRegex(pattern) {
+		re, err := CompileRegex(pattern)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(tag), nil
+	}
 
-	case ">=":
-		return strings.Compare(tag, pattern[2:]) >= 0, nil
+	if IsRange(pattern) {
+		for _, constraint := range strings.Fields(pattern) {
+			match, err := matchPattern(tag, constraint)
+			if err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+	}
 
-	case ">":
-		return strings.Compare(tag, pattern[1:]) > 0, nil
+	// with a semantic version as operand, only tags that are semantic versions
+	// can match, so that e.g. '>=1.0' does not match 'latest'; other operands
+	// are compared lexically
+	switch op := GetComparisonOperator(pattern); op {
+	case "<=", "<", ">=", ">", "~", "^":
+		operand, ok := parseVersion(pattern[len(op):])
+		if !ok {
+			if op == "~" || op == "^" {
+				return false, fmt.Errorf(
+					"'%s' requires a semantic version, got %s", op, pattern)
+			}
+			return compareLexical(op, tag, pattern[len(op):]), nil
+		}
+		v, ok := parseVersion(tag)
+		if !ok {
+			return false, nil
+		}
+		return v.matches(op, operand), nil
 
 	case "":
 
@@ -115,6 +115,246 @@ func TestMatch(t *testing.T) {
 			false,
 			nil,
 		},
+		{
+			"semver >= with multi-digit minor",
+			"v1.10.0",
+			[]string{">=v1.2.3"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"semver > with multi-digit major",
+			"v10",
+			[]string{">v9"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"semver comparison without v prefix in pattern",
+			"v1.2.3",
+			[]string{"<=1.2.3"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"pre-release lower than release",
+			"1.2.3-rc.1",
+			[]string{"<1.2.3"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"pre-release numeric identifiers",
+			"1.2.3-rc.10",
+			[]string{">1.2.3-rc.9"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"no match for non-semver tag",
+			"latest",
+			[]string{">=v1.0"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"no match for non-semver tag with greater than",
+			"latest",
+			[]string{">1.0"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"no match for non-semver tag with less or equal",
+			"latest",
+			[]string{"<=9"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"no match for non-semver tag with greater than, stable",
+			"stable",
+			[]string{">v0.1"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"no match for non-semver tag with less or equal, stable",
+			"stable",
+			[]string{"<=v10.0.0"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"lexical comparison with non-semver operand",
+			"stable",
+			[]string{">=rc"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"lexical comparison with non-semver operand, no match",
+			"latest",
+			[]string{">stable"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"range of date tags",
+			"2026-10-17",
+			[]string{">=2026-01-01 <2027-01-01"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"lexical comparison of semver tag with non-semver operand",
+			"1.2.3",
+			[]string{"<=latest"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"no match for non-semver tag in range",
+			"stable",
+			[]string{">=1.0 <=99"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"range match",
+			"1.9.9",
+			[]string{">=1.2 <2.0"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"range upper bound",
+			"2.0.0",
+			[]string{">=1.2 <2.0"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"range lower bound",
+			"1.1.9",
+			[]string{">=1.2 <2.0"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"tilde match",
+			"v1.4.7",
+			[]string{"~1.4"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"tilde no match",
+			"v1.5.0",
+			[]string{"~1.4"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"tilde excludes pre-release of upper bound",
+			"1.5.0-rc1",
+			[]string{"~1.4"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"caret match",
+			"2.9.1",
+			[]string{"^2"},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"caret no match",
+			"3.0.0",
+			[]string{"^2"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"caret with zero major",
+			"0.3.0",
+			[]string{"^0.2.3"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"caret with non-semver tag",
+			"stable",
+			[]string{"^2"},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"regex match",
+			"v1.2.3-alpine",
+			[]string{`regex:^v\d+\.\d+\.\d+(-alpine)?$`},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"regex no match",
+			"v1.2.3-slim",
+			[]string{`regex:^v\d+\.\d+\.\d+(-alpine)?$`},
+			[]string{},
+			false,
+			nil,
+		},
+		{
+			"regex with spaces is not a range",
+			"v1",
+			[]string{`regex:^v1( |$)`},
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"regex in exclude",
+			"1.2.3-rc1",
+			[]string{"^1"},
+			[]string{`regex:-rc\d+$`},
+			false,
+			nil,
+		},
+		{
+			"range in exclude",
+			"1.5.2",
+			[]string{"^1"},
+			[]string{">=1.5 <1.6"},
+			false,
+			nil,
+		},
 	}
 
 	for _, testCase := range testCases {